@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// adminHandler returns handler serving admin API. It is meant to be exposed
+// on a private address only.
+func (hh *hookHandler) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", hh.statsHandler)
+	mux.HandleFunc("/metrics", hh.metricsHandler)
+	mux.HandleFunc("/healthz", hh.healthHandler)
+	if len(hh.adminTok) > 0 {
+		mux.HandleFunc("/pause", hh.pauseHandler(true))
+		mux.HandleFunc("/resume", hh.pauseHandler(false))
+	}
+	if hh.pprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	return mux
+}
+
+// statsHandler reports queue length and per-endpoint stats as JSON
+func (hh *hookHandler) statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Queued    int                      `json:"queued"`
+		Endpoints map[string]endpointStats `json:"endpoints"`
+	}{
+		Queued:    hh.queued(),
+		Endpoints: hh.stats.snapshot(),
+	})
+}
+
+// metricsHandler exposes metrics in Prometheus text format
+func (hh *hookHandler) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	hh.metrics.writeTo(w)
+	fmt.Fprintf(w, "# HELP ghwh_queued_jobs Number of jobs waiting in the queue.\n"+
+		"# TYPE ghwh_queued_jobs gauge\nghwh_queued_jobs %d\n", hh.queued())
+}
+
+// pauseHandler returns handler pausing or resuming endpoint given in endpoint
+// query parameter, i.e. POST /pause?endpoint=/hook1
+func (hh *hookHandler) pauseHandler(pause bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+			return
+		}
+		tok := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(tok), []byte(hh.adminTok)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		path := r.URL.Query().Get("endpoint")
+		if !hh.setPaused(path, pause) {
+			http.Error(w, "unknown endpoint", http.StatusNotFound)
+			return
+		}
+		if pause {
+			log.Printf("%s: paused via admin API", path)
+		} else {
+			log.Printf("%s: resumed via admin API", path)
+		}
+	}
+}
+
+// healthHandler reports whether ghwh is up. With deep=1 query parameter it
+// also checks that all configured commands are present and executable,
+// responding with 503 and list of problems otherwise.
+func (hh *hookHandler) healthHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.URL.Query().Get("deep") == "1" {
+		hh.mu.RLock()
+		cfg := hh.cfg
+		hh.mu.RUnlock()
+		if problems := hh.health.check(cfg, hh.runnerFor); len(problems) > 0 {
+			http.Error(w, strings.Join(problems, "\n"), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// healthCacheTTL is how long results of deep health check are reused, so that
+// frequent probes don't hammer the filesystem
+const healthCacheTTL = 10 * time.Second
+
+// healthCache holds results of the last deep health check
+type healthCache struct {
+	mu       sync.Mutex
+	checked  time.Time
+	problems []string
+}
+
+// check returns list of commands from cfg that cannot be found or executed,
+// reusing results of the previous check if it's recent enough. Commands of
+// endpoints run with a prefix returned by runner are run by the prefix
+// command, so only it is looked up for them.
+func (hc *healthCache) check(cfg map[string]endpoint, runner func(endpoint) []string) []string {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if time.Since(hc.checked) < healthCacheTTL {
+		return hc.problems
+	}
+	var problems []string
+	for _, k := range sortedKeys(cfg) {
+		names := cfg[k].commands()
+		if prefix := runner(cfg[k]); len(prefix) > 0 && len(names) > 0 {
+			names = prefix[:1]
+		}
+		for _, name := range names {
+			if _, err := exec.LookPath(name); err != nil {
+				problems = append(problems, k+": "+err.Error())
+			}
+		}
+	}
+	hc.checked, hc.problems = time.Now(), problems
+	return problems
+}
+
+func sortedKeys(cfg map[string]endpoint) []string {
+	keys := make([]string, 0, len(cfg))
+	for k := range cfg {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
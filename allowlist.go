@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// commandPolicy lists commands config may run, see -allowed-commands. Entries
+// with slash match command given by the same path, the ones without match
+// commands given by name only, which are looked up in PATH of ghwh. Empty
+// policy allows any command.
+type commandPolicy []string
+
+// newCommandPolicy parses comma-separated list of allowed commands
+func newCommandPolicy(list string) commandPolicy {
+	var p commandPolicy
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); len(s) > 0 {
+			p = append(p, s)
+		}
+	}
+	return p
+}
+
+// allows reports whether command name may be run
+func (p commandPolicy) allows(name string) bool {
+	if len(p) == 0 {
+		return true
+	}
+	for _, s := range p {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns error if endpoint may run command policy doesn't allow,
+// including its runner prefix and secret command
+func (p commandPolicy) check(ep endpoint) error {
+	if len(p) == 0 {
+		return nil
+	}
+	names := ep.commands()
+	for _, list := range [][]string{ep.RunnerPrefix, ep.SecretCommand} {
+		if len(list) > 0 {
+			names = append(names, list[0])
+		}
+	}
+	for _, name := range names {
+		if !p.allows(name) {
+			return fmt.Errorf("command %q is not allowed", name)
+		}
+	}
+	return nil
+}
+
+// checkFlags returns error if any of command lines set by flags, -runner and
+// lifecycle commands, starts with command policy doesn't allow
+func (p commandPolicy) checkFlags(flags map[string]string) error {
+	for flag, line := range flags {
+		if args := strings.Fields(line); len(args) > 0 && !p.allows(args[0]) {
+			return fmt.Errorf("-%s: command %q is not allowed", flag, args[0])
+		}
+	}
+	return nil
+}
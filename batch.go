@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// batch accumulates deliveries to endpoint with batch interval set
+type batch struct {
+	job   execEnv // the latest delivery
+	count int
+	refs  []string // unique refs in order they were first seen
+}
+
+// addBatch adds job to its endpoint batch, scheduling batch to be queued
+// once interval passes if it's the first delivery since the last run
+func (hh *hookHandler) addBatch(job execEnv) {
+	key := job.endpoint.path
+	hh.mu.Lock()
+	defer hh.mu.Unlock()
+	b, ok := hh.batches[key]
+	if !ok {
+		if hh.batches == nil {
+			hh.batches = make(map[string]*batch)
+		}
+		b = &batch{}
+		hh.batches[key] = b
+		time.AfterFunc(job.endpoint.BatchInterval, func() { hh.flushBatch(hh.base, key) })
+	}
+	b.job, b.count = job, b.count+1
+	for _, ref := range b.refs {
+		if ref == job.payload.Ref {
+			return
+		}
+	}
+	b.refs = append(b.refs, job.payload.Ref)
+}
+
+// flushBatch queues job for accumulated endpoint batch the same way a single
+// delivery is queued, see hookHandler.enqueue; with -no-spillover it waits for
+// a free slot until ctx is done. Batch is dropped only if it can't be queued.
+func (hh *hookHandler) flushBatch(ctx context.Context, key string) {
+	hh.mu.Lock()
+	b := hh.batches[key]
+	delete(hh.batches, key)
+	hh.mu.Unlock()
+	if b == nil {
+		return
+	}
+	job := b.job
+	job.batchCount, job.batchRefs = b.count, b.refs
+	if err := hh.journal.add(&job); err != nil {
+		log.Printf("%s: id: %q, journal: %v", key, job.requestID, err)
+	}
+	if err := hh.enqueue(ctx, hh.queueFor(job.endpoint), job); err != nil {
+		log.Printf("%s: id: %q, dropping batch of %d deliveries: %v",
+			key, job.requestID, b.count, err)
+		return
+	}
+	hh.infof("%s: id: %q, queued batch of %d deliveries", key, job.requestID, b.count)
+}
+
+// flushBatches queues all pending batches without waiting for their
+// intervals to pass, so that they are run on shutdown
+func (hh *hookHandler) flushBatches(ctx context.Context) {
+	hh.mu.RLock()
+	keys := make([]string, 0, len(hh.batches))
+	for k := range hh.batches {
+		keys = append(keys, k)
+	}
+	hh.mu.RUnlock()
+	for _, k := range keys {
+		hh.flushBatch(ctx, k)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import "sync"
+
+// busySet tracks repositories having jobs queued or running, for endpoints
+// rejecting new deliveries until previous job is done
+type busySet struct {
+	mu sync.Mutex
+	m  map[string]bool
+}
+
+// acquire marks key busy, reporting false if it already is
+func (b *busySet) acquire(key string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.m[key] {
+		return false
+	}
+	if b.m == nil {
+		b.m = make(map[string]bool)
+	}
+	b.m[key] = true
+	return true
+}
+
+func (b *busySet) release(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.m, key)
+}
+
+// busyKey returns key job is tracked by in busySet
+func busyKey(item execEnv) string {
+	r := item.payload.Repository
+	return item.endpoint.path + " " + r.FullName + " " + r.Name
+}
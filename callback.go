@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// callbackResult is a JSON body posted to endpoint callback url once its
+// command completes; output holds tail of failed command output
+type callbackResult struct {
+	Endpoint  string  `json:"endpoint"`
+	Event     string  `json:"event"`
+	Repo      string  `json:"repo"`
+	Ref       string  `json:"ref"`
+	RequestID string  `json:"request_id"`
+	Success   bool    `json:"success"`
+	ExitCode  *int    `json:"exit_code,omitempty"` // not set if command could not start
+	Error     string  `json:"error,omitempty"`
+	Duration  float64 `json:"duration"` // seconds
+	Output    string  `json:"output,omitempty"`
+}
+
+// callback reports command result to endpoint callback url, signing it with
+// endpoint outbound secret; output is the tail of failed command output
+func callback(item execEnv, err error, took time.Duration, output string) {
+	res := callbackResult{
+		Endpoint:  item.endpoint.path,
+		Event:     item.event,
+		Repo:      item.payload.Repository.FullName,
+		Ref:       item.payload.Ref,
+		RequestID: item.requestID,
+		Success:   err == nil,
+		Duration:  took.Seconds(),
+	}
+	var ee *exitError
+	switch {
+	case err == nil:
+		res.ExitCode = new(int)
+	case errors.As(err, &ee):
+		res.ExitCode = &ee.code
+	}
+	if err != nil {
+		res.Error, res.Output = err.Error(), output
+	}
+	body, err := json.Marshal(res)
+	if err != nil {
+		log.Printf("%s: callback: %v", item.endpoint.path, err)
+		return
+	}
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+	header.Set("X-Request-Id", item.requestID)
+	signOutbound(header, item.endpoint.OutboundSecret, body)
+	if err := post(item.endpoint.Callback, header, body); err != nil {
+		log.Printf("%s: callback to %s: %v", item.endpoint.path, redactedURL(item.endpoint.Callback), err)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// debugServer implements -debug-server mode: it accepts any request on any
+// path and logs its details, including signature validity against secret, to
+// help setting up webhooks. It returns once interrupted.
+func debugServer(network, addr, secret string) error {
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Handler:        http.HandlerFunc(debugHandler(secret)),
+		MaxHeaderBytes: 1 << 20,
+		ReadTimeout:    15 * time.Second,
+		WriteTimeout:   15 * time.Second,
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	log.Printf("debug server listening at %s, press Ctrl-C to exit", ln.Addr())
+	if len(secret) == 0 {
+		log.Print("secret is not set, signatures are not checked")
+	}
+	if err := server.Serve(ln); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// debugHandler logs request details, replying 200 to any request
+func debugHandler(secret string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var b strings.Builder
+		b.WriteString("request from " + r.RemoteAddr + ": " + r.Method + " " + r.URL.RequestURI() + "\n")
+		keys := make([]string, 0, len(r.Header))
+		for k := range r.Header {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			for _, v := range r.Header[k] {
+				b.WriteString("  " + k + ": " + v + "\n")
+			}
+		}
+		raw, err := io.ReadAll(r.Body)
+		if err != nil {
+			log.Printf("%sbody read error: %v", &b, err)
+			http.Error(w, "body read error", http.StatusBadRequest)
+			return
+		}
+		body := raw
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			if body, err = gunzip(raw); err != nil {
+				b.WriteString("malformed gzip body: " + err.Error() + "\n")
+				body = raw
+			}
+		}
+		for _, s := range signatureHeaders {
+			got := r.Header.Get(s.header)
+			b.WriteString(s.header + ": ")
+			switch {
+			case len(got) == 0:
+				b.WriteString("not set")
+			case len(secret) == 0:
+				b.WriteString("not checked")
+			case !strings.HasPrefix(got, s.algo+"="):
+				b.WriteString("MALFORMED")
+			case validSignature(s.algo, []byte(secret), got[len(s.algo)+1:], raw, body):
+				b.WriteString("valid")
+			default:
+				b.WriteString("INVALID")
+			}
+			if len(secret) > 0 {
+				b.WriteString(", computed " + s.algo + "=" + hmacHex(s.algo, []byte(secret), raw))
+				if !bytes.Equal(raw, body) {
+					b.WriteString(", for uncompressed body " + s.algo + "=" +
+						hmacHex(s.algo, []byte(secret), body))
+				}
+			}
+			b.WriteByte('\n')
+		}
+		event := r.Header.Get("X-Github-Event")
+		if parse, ok := parsers[event]; ok {
+			p, err := parse(body)
+			if err != nil {
+				b.WriteString(event + " payload: " + err.Error() + "\n")
+			} else {
+				b.WriteString("repository: " + p.Repository.FullName + ", ref: " + p.Ref)
+				if len(p.Action) > 0 {
+					b.WriteString(", action: " + p.Action)
+				}
+				b.WriteByte('\n')
+			}
+		}
+		var out bytes.Buffer
+		if err := json.Indent(&out, body, "", "  "); err == nil {
+			b.WriteString("payload:\n" + out.String())
+		} else {
+			b.WriteString("body is not json (" + err.Error() + "), " +
+				strconv.Itoa(len(body)) + " bytes")
+		}
+		log.Print(&b)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// deployLog tracks the last successfully deployed commit per endpoint and
+// ref, so that redeliveries of the same push can be skipped
+type deployLog struct {
+	mu sync.Mutex
+	m  map[string]map[string]string // endpoint path → ref → commit sha
+}
+
+func newDeployLog() *deployLog {
+	return &deployLog{m: make(map[string]map[string]string)}
+}
+
+// refs returns map of deployed commits of endpoint, loading it from the
+// endpoint state file on first use. Must be called with d.mu held.
+func (d *deployLog) refs(ep endpoint) (map[string]string, error) {
+	if m, ok := d.m[ep.path]; ok {
+		return m, nil
+	}
+	m := make(map[string]string)
+	if len(ep.DeployedFile) > 0 {
+		b, err := os.ReadFile(ep.DeployedFile)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+		case err != nil:
+			return nil, err
+		default:
+			if err := json.Unmarshal(b, &m); err != nil {
+				return nil, err
+			}
+		}
+	}
+	d.m[ep.path] = m
+	return m, nil
+}
+
+// deployed reports whether sha is the last deployed commit of ref
+func (d *deployLog) deployed(ep endpoint, ref, sha string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	m, err := d.refs(ep)
+	if err != nil {
+		return false, err
+	}
+	return m[ref] == sha, nil
+}
+
+// record saves sha as the last deployed commit of ref, writing state file if
+// endpoint has one
+func (d *deployLog) record(ep endpoint, ref, sha string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	m, err := d.refs(ep)
+	if err != nil {
+		return err
+	}
+	m[ref] = sha
+	if len(ep.DeployedFile) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(ep.DeployedFile, b)
+}
+
+// writeFileAtomic writes data to a temporary file next to name, then renames
+// it over name, so that readers never see partially written file
+func writeFileAtomic(name string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".ghwh-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
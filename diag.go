@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bodyHints returns likely reasons for signature mismatch judging by request
+// body shape, which usually means body was altered on its way, i.e. by proxy
+func bodyHints(h http.Header, raw []byte) []string {
+	var out []string
+	if h.Get("Content-Encoding") == "" {
+		switch {
+		case bytes.HasPrefix(raw, []byte("payload=")):
+			out = append(out, "body is form-encoded, either hook content type is not application/json, or proxy re-encoded body")
+		case bytes.HasPrefix(raw, []byte("\xef\xbb\xbf")):
+			out = append(out, "body starts with UTF-8 byte order mark, which GitHub doesn't send")
+		case !json.Valid(raw):
+			out = append(out, "body is not valid JSON, it may have been truncated or altered")
+		}
+	}
+	if bytes.Contains(raw, []byte("\r\n")) {
+		out = append(out, "body has CRLF line breaks, which usually means it was rewritten on its way")
+	}
+	if bytes.HasSuffix(raw, []byte("\n")) {
+		out = append(out, "body ends with newline, which may have been added on its way")
+	}
+	return out
+}
+
+const (
+	maxDiagRequests = 50          // saved requests kept, older ones are removed
+	maxDiagBody     = 64 << 10    // saved body prefix size
+	diagInterval    = time.Second // minimal interval between saves
+)
+
+// diagStore saves requests failing signature check to a directory, see
+// -signature-diagnostics. As anybody can send such requests, saves are rate
+// limited, bodies are truncated, and only the latest requests are kept.
+type diagStore struct {
+	dir string
+
+	mu   sync.Mutex
+	last time.Time // time of the last save
+}
+
+func newDiagStore(dir string) *diagStore {
+	return &diagStore{dir: dir}
+}
+
+// diagnoseSignature logs likely reasons for signature mismatch of request and
+// saves its headers and body bytes signature was checked against
+func (ds *diagStore) diagnoseSignature(path, reqID string, h http.Header, raw []byte) {
+	hints := bodyHints(h, raw)
+	for _, s := range hints {
+		log.Printf("%s: id: %q, signature mismatch diagnostics: %s", path, reqID, s)
+	}
+	if len(hints) == 0 {
+		log.Printf("%s: id: %q, signature mismatch diagnostics: body looks unaltered, secret is likely wrong",
+			path, reqID)
+	}
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	now := time.Now()
+	if now.Sub(ds.last) < diagInterval {
+		log.Printf("%s: id: %q, request not saved, previous one was saved less than %v ago",
+			path, reqID, diagInterval)
+		return
+	}
+	ds.last = now
+	name := filepath.Join(ds.dir, safeName(reqID))
+	var hdr bytes.Buffer
+	h.Write(&hdr)
+	if err := os.WriteFile(name+".headers", hdr.Bytes(), 0600); err != nil {
+		log.Printf("%s: id: %q, saving request headers: %v", path, reqID, err)
+		return
+	}
+	saved := raw[:min(len(raw), maxDiagBody)]
+	if err := os.WriteFile(name+".body", saved, 0600); err != nil {
+		log.Printf("%s: id: %q, saving request body: %v", path, reqID, err)
+		return
+	}
+	log.Printf("%s: id: %q, %d of %d bytes of signed body (sha256 %x) saved to %s.body",
+		path, reqID, len(saved), len(raw), sha256.Sum256(raw), name)
+	ds.rotate()
+}
+
+// rotate removes files of the oldest saved requests, keeping the latest
+// maxDiagRequests of them. Must be called with ds.mu held.
+func (ds *diagStore) rotate() {
+	entries, err := os.ReadDir(ds.dir)
+	if err != nil {
+		log.Printf("signature diagnostics cleanup: %v", err)
+		return
+	}
+	type saved struct {
+		name string // path without suffix
+		mod  time.Time
+	}
+	var list []saved
+	for _, e := range entries {
+		base, ok := strings.CutSuffix(e.Name(), ".body")
+		if !ok || !e.Type().IsRegular() {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		list = append(list, saved{name: filepath.Join(ds.dir, base), mod: fi.ModTime()})
+	}
+	if len(list) <= maxDiagRequests {
+		return
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].mod.Before(list[j].mod) })
+	for _, s := range list[:len(list)-maxDiagRequests] {
+		os.Remove(s.name + ".body")
+		os.Remove(s.name + ".headers")
+	}
+}
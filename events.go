@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// payloadParser decodes payload of a particular event type
+type payloadParser func(body []byte) (hookPayload, error)
+
+// parsers maps supported event types to their payload parsers; supporting a
+// new event is a matter of registering its parser here
+var parsers = map[string]payloadParser{
+	"push":         parsePush,
+	"release":      parseRelease,
+	"pull_request": parsePullRequest,
+	"create":       parseRefEvent,
+	"delete":       parseRefEvent,
+}
+
+// errBadPayload is returned by parsers for well-formed json missing
+// event-specific data
+var errBadPayload = errors.New("malformed payload")
+
+func parsePush(body []byte) (hookPayload, error) {
+	var payload hookPayload
+	err := json.Unmarshal(body, &payload)
+	return payload, err
+}
+
+func parseRelease(body []byte) (hookPayload, error) {
+	payload, err := parsePush(body)
+	if err != nil {
+		return payload, err
+	}
+	if payload.Release == nil {
+		return payload, errBadPayload
+	}
+	// releases carry no ref, use the one of a release tag so that per-ref
+	// rules apply to them too
+	payload.Ref = "refs/tags/" + payload.Release.TagName
+	return payload, nil
+}
+
+func parsePullRequest(body []byte) (hookPayload, error) {
+	payload, err := parsePush(body)
+	if err != nil {
+		return payload, err
+	}
+	if payload.PullRequest == nil {
+		return payload, errBadPayload
+	}
+	// use target branch as ref, so that per-ref rules select command by
+	// where pull request is merged to
+	payload.Ref = "refs/heads/" + payload.PullRequest.Base.Ref
+	return payload, nil
+}
+
+// parseRefEvent parses create and delete events, which carry short ref name
+// along with its type
+func parseRefEvent(body []byte) (hookPayload, error) {
+	payload, err := parsePush(body)
+	if err != nil {
+		return payload, err
+	}
+	// expand ref to its full form, so that per-ref rules apply the same way
+	// they do to pushes
+	switch payload.RefType {
+	case "branch":
+		payload.Ref = "refs/heads/" + payload.Ref
+	case "tag":
+		payload.Ref = "refs/tags/" + payload.Ref
+	default:
+		return payload, errBadPayload
+	}
+	return payload, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+)
+
+// route is a command selected by expression evaluated against the job
+type route struct {
+	When    string // expression, see exprEnv for available fields
+	Command string
+	Args    []string
+	Exec    []string
+
+	program *vm.Program
+}
+
+// exprEnv holds job fields available to endpoint expressions; fields not
+// set for particular event are empty
+type exprEnv struct {
+	Event        string `expr:"event"`
+	Action       string `expr:"action"`
+	Ref          string `expr:"ref"`
+	RefType      string `expr:"ref_type"`
+	Branch       string `expr:"branch"`
+	Tag          string `expr:"tag"`
+	After        string `expr:"after"`
+	Repo         string `expr:"repo"`
+	RepoFullName string `expr:"repo_full_name"`
+	Org          string `expr:"org"`
+	ReleaseTag   string `expr:"release_tag"`
+	PRNumber     int    `expr:"pr_number"`
+	PRMerged     bool   `expr:"pr_merged"`
+	PRBase       string `expr:"pr_base"`
+	PRHead       string `expr:"pr_head"`
+}
+
+// exprEnv returns fields of the job available to expressions
+func (item execEnv) exprEnv() exprEnv {
+	p := item.payload
+	env := exprEnv{
+		Event:        item.event,
+		Action:       p.Action,
+		Ref:          p.Ref,
+		RefType:      p.RefType,
+		After:        p.After,
+		Repo:         p.Repository.Name,
+		RepoFullName: p.Repository.FullName,
+		Org:          p.Organization.Login,
+	}
+	switch kind, name := refKind(p.Ref); kind {
+	case "branch":
+		env.Branch = name
+	case "tag":
+		env.Tag = name
+	}
+	if rel := p.Release; rel != nil {
+		env.ReleaseTag = rel.TagName
+	}
+	if pr := p.PullRequest; pr != nil {
+		env.PRNumber, env.PRMerged = pr.Number, pr.Merged
+		env.PRBase, env.PRHead = pr.Base.Ref, pr.Head.Ref
+	}
+	return env
+}
+
+// compileExpr compiles boolean expression over exprEnv fields
+func compileExpr(src string) (*vm.Program, error) {
+	return expr.Compile(src, expr.Env(exprEnv{}), expr.AsBool())
+}
+
+// evalExpr reports whether compiled expression is true for the job
+func evalExpr(p *vm.Program, item execEnv) (bool, error) {
+	out, err := expr.Run(p, item.exprEnv())
+	if err != nil {
+		return false, err
+	}
+	return out.(bool), nil
+}
+
+// initExprs compiles endpoint expressions
+func initExprs(ep *endpoint) error {
+	if len(ep.When) > 0 {
+		p, err := compileExpr(ep.When)
+		if err != nil {
+			return fmt.Errorf("when: %v", err)
+		}
+		ep.when = p
+	}
+	for i := range ep.Routes {
+		r := &ep.Routes[i]
+		if len(r.When) == 0 {
+			return fmt.Errorf("route %d: empty expression", i+1)
+		}
+		if err := checkExec(r.Exec, r.Command); err != nil {
+			return fmt.Errorf("route %d: %v", i+1, err)
+		}
+		if len(r.Exec) == 0 && len(r.Command) == 0 {
+			return fmt.Errorf("route %d: no command", i+1)
+		}
+		p, err := compileExpr(r.When)
+		if err != nil {
+			return fmt.Errorf("route %d: %v", i+1, err)
+		}
+		r.program = p
+	}
+	return nil
+}
+
+// matchRoute returns first endpoint route with expression true for the job
+func matchRoute(item execEnv) (route, bool, error) {
+	for i, r := range item.endpoint.Routes {
+		ok, err := evalExpr(r.program, item)
+		if err != nil {
+			return route{}, false, fmt.Errorf("route %d: %w", i+1, err)
+		}
+		if ok {
+			return r, true, nil
+		}
+	}
+	return route{}, false, nil
+}
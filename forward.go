@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// forwardedHeaders lists request headers passed along with forwarded payload
+var forwardedHeaders = [...]string{
+	"Content-Type",
+	"Content-Encoding",
+	"User-Agent",
+	"X-Github-Event",
+	"X-Github-Delivery",
+	"X-Github-Hook-Id",
+	"X-Hub-Signature",
+	"X-Hub-Signature-256",
+}
+
+// forwardAttempts is the number of attempts made to deliver forwarded payload
+// or callback
+const forwardAttempts = 3
+
+var forwardClient = &http.Client{Timeout: 30 * time.Second}
+
+// outboundSignatureHeader holds HMAC-SHA256 of outbound request body signed
+// with endpoint outbound secret, in the same "sha256=<hex>" form GitHub uses
+const outboundSignatureHeader = "X-GHWH-Signature-256"
+
+// signOutbound adds signature header to outbound request headers if secret is
+// not empty
+func signOutbound(header http.Header, secret string, body []byte) {
+	if len(secret) == 0 {
+		return
+	}
+	header.Set(outboundSignatureHeader, "sha256="+hmacHex("sha256", []byte(secret), body))
+}
+
+// forward POSTs body to url with headers copied from the original request,
+// retrying on network errors and 5xx responses. If secret is not empty,
+// request is signed with it.
+func forward(url string, orig http.Header, secret string, body []byte) error {
+	header := make(http.Header)
+	for _, k := range forwardedHeaders {
+		if v := orig.Get(k); len(v) > 0 {
+			header.Set(k, v)
+		}
+	}
+	signOutbound(header, secret, body)
+	return post(url, header, body)
+}
+
+// post POSTs body to url, retrying on network errors and 5xx responses
+func post(url string, header http.Header, body []byte) error {
+	var err error
+	for i := 0; i < forwardAttempts; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(i) * 2 * time.Second)
+		}
+		var retry bool
+		if retry, err = forwardOnce(url, header, body); err == nil || !retry {
+			return err
+		}
+	}
+	return err
+}
+
+// forwardOnce does a single forward attempt, reporting whether it is worth
+// retrying on error
+func forwardOnce(url string, header http.Header, body []byte) (retry bool, err error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return false, withoutURL(err)
+	}
+	req.Header = header
+	resp, err := forwardClient.Do(req)
+	if err != nil {
+		return true, withoutURL(err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<20))
+	switch {
+	case resp.StatusCode >= 500:
+		return true, fmt.Errorf("unexpected response status: %s", resp.Status)
+	case resp.StatusCode >= 300:
+		return false, fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	return false, nil
+}
+
+// withoutURL strips url off error returned by http.Client, as its query may
+// carry credentials; callers log url with redactedURL instead
+func withoutURL(err error) error {
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		return ue.Err
+	}
+	return err
+}
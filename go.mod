@@ -1,8 +1,15 @@
 module github.com/artyom/ghwh
 
-go 1.12
+go 1.23
 
 require (
 	github.com/artyom/autoflags v1.1.1
+	github.com/creack/pty v1.1.24
+	github.com/expr-lang/expr v1.17.8
+	github.com/fsnotify/fsnotify v1.10.1
+	github.com/santhosh-tekuri/jsonschema/v6 v6.0.3
+	golang.org/x/sys v0.13.0
 	gopkg.in/yaml.v2 v2.4.0
 )
+
+require golang.org/x/text v0.14.0 // indirect
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// ioSemaphore limits total weight of concurrently running I/O heavy commands
+// across all endpoints, see -max-io-concurrency. Waiters are served in order
+// they arrived in, so that heavy commands are not starved by light ones.
+type ioSemaphore struct {
+	size int
+
+	mu      sync.Mutex
+	cur     int
+	waiters []*ioWaiter
+}
+
+type ioWaiter struct {
+	n     int
+	ready chan struct{} // closed once weight is acquired
+}
+
+func newIOSemaphore(size int) *ioSemaphore {
+	return &ioSemaphore{size: size}
+}
+
+// acquire waits until weight n is available, or ctx is done. Weight over
+// semaphore size is capped, so that such command runs exclusively.
+func (s *ioSemaphore) acquire(ctx context.Context, n int) error {
+	n = min(n, s.size)
+	s.mu.Lock()
+	if s.cur+n <= s.size && len(s.waiters) == 0 {
+		s.cur += n
+		s.mu.Unlock()
+		return nil
+	}
+	w := &ioWaiter{n: n, ready: make(chan struct{})}
+	s.waiters = append(s.waiters, w)
+	s.mu.Unlock()
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-w.ready: // acquired while giving up
+		s.cur -= n
+	default:
+		for i, v := range s.waiters {
+			if v == w {
+				s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+				break
+			}
+		}
+	}
+	s.wake()
+	return ctx.Err()
+}
+
+// release returns weight n acquired before
+func (s *ioSemaphore) release(n int) {
+	n = min(n, s.size)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cur -= n
+	s.wake()
+}
+
+// wake hands available weight to waiters in order. Must be called with s.mu
+// held.
+func (s *ioSemaphore) wake() {
+	for len(s.waiters) > 0 {
+		w := s.waiters[0]
+		if s.cur+w.n > s.size {
+			return
+		}
+		s.cur += w.n
+		s.waiters = s.waiters[1:]
+		close(w.ready)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jobJournal keeps every queued job as a file in a directory until the job
+// is processed, so that jobs queued or running when ghwh crashes or restarts
+// are replayed on the next start. Files are named by receive time and job
+// request id, so that their lexical order is the order jobs were queued in.
+// Methods of nil jobJournal do nothing.
+type jobJournal struct {
+	dir string
+
+	mu  sync.Mutex
+	seq int
+}
+
+const journalSuffix = ".job"
+
+// newJobJournal returns jobJournal keeping jobs in dir, which is created if
+// needed
+func newJobJournal(dir string) (*jobJournal, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &jobJournal{dir: dir}, nil
+}
+
+// add writes job to a new journal file, recording its name in the job
+func (jj *jobJournal) add(item *execEnv) error {
+	if jj == nil {
+		return nil
+	}
+	b, err := json.Marshal(serializeJob(*item))
+	if err != nil {
+		return err
+	}
+	jj.mu.Lock()
+	jj.seq++
+	name := filepath.Join(jj.dir, fmt.Sprintf("%020d-%06d-%s%s",
+		time.Now().UnixNano(), jj.seq%1000000, safeName(item.requestID), journalSuffix))
+	jj.mu.Unlock()
+	if err := writeFileAtomic(name, b); err != nil {
+		return err
+	}
+	item.journal = name
+	return nil
+}
+
+// remove deletes journal file of job, if it has one
+func (jj *jobJournal) remove(item execEnv) {
+	if jj == nil || len(item.journal) == 0 {
+		return
+	}
+	if err := os.Remove(item.journal); err != nil {
+		log.Printf("journal entry removal: %v", err)
+	}
+}
+
+// list returns paths of journal files in order jobs were queued in
+func (jj *jobJournal) list() ([]string, error) {
+	entries, err := os.ReadDir(jj.dir)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, e := range entries {
+		if e.Type().IsRegular() && strings.HasSuffix(e.Name(), journalSuffix) {
+			out = append(out, filepath.Join(jj.dir, e.Name()))
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// replayJournal queues jobs left in journal by the previous run, waiting for
+// room in their queues. Jobs of endpoints no longer configured are dropped.
+// It's called before listeners start, so journal only holds files of the
+// previous run, and replayed jobs are queued ahead of new deliveries. Replay
+// stops once ctx is done, jobs not queued by then stay in journal.
+func (hh *hookHandler) replayJournal(ctx context.Context) {
+	if hh.journal == nil {
+		return
+	}
+	names, err := hh.journal.list()
+	if err != nil {
+		log.Printf("listing journal: %v", err)
+		return
+	}
+	if len(names) > 0 {
+		log.Printf("replaying %d journaled jobs", len(names))
+	}
+	for _, name := range names {
+		if ctx.Err() != nil {
+			return // shutting down, rest is replayed on the next start
+		}
+		b, err := os.ReadFile(name)
+		if err != nil {
+			log.Printf("loading journaled job: %v", err)
+			continue
+		}
+		var job spilledJob
+		if err := json.Unmarshal(b, &job); err != nil {
+			log.Printf("dropping malformed journaled job %s: %v", name, err)
+			os.Remove(name)
+			continue
+		}
+		item, ok := hh.resolve(job)
+		if !ok {
+			log.Printf("repo: %q, ref: %q, id: %q, endpoint %s is no longer configured, dropping journaled job",
+				job.Payload.Repository.Name, job.Payload.Ref, job.RequestID, job.Endpoint)
+			os.Remove(name)
+			continue
+		}
+		item.journal = name
+		q := hh.queueFor(item.endpoint)
+		if q == nil || !q.pushWait(ctx, item) {
+			return // shutting down, job is replayed on the next start
+		}
+	}
+}
+
+// sameDir reports whether both paths refer to the same existing directory
+func sameDir(a, b string) bool {
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	fb, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(fa, fb)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os/exec"
+	"strings"
+)
+
+// runLifecycle runs startup or shutdown command, given as command line split
+// on spaces and prefixed with -runner, limited by the configured command
+// timeout, and logs its result
+func (hh *hookHandler) runLifecycle(what, command string) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return
+	}
+	ctx, cancel := context.Background(), func() {}
+	if hh.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, hh.timeout)
+	}
+	defer cancel()
+	name, rest := withPrefix(hh.runner, args[0], args[1:])
+	cmd := exec.CommandContext(ctx, name, rest...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		log.Printf("%s command %v: %v", what, args, classifyExit(ctx, err))
+		if out = bytes.TrimSpace(out); len(out) > 0 {
+			log.Printf("%s command output:\n%s", what, out)
+		}
+		return
+	}
+	hh.infof("%s command %v finished", what, args)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// limitExecCmd is the internal subcommand command is run via when endpoint
+// sets limits, see limits.wrap
+const limitExecCmd = "limit-exec"
+
+// limitExecNotFound is exit status of limitExecCmd when command doesn't
+// exist, the same one shells and wrappers like env(1) use, so that runJob
+// can report it as not found
+const limitExecNotFound = 127
+
+// limits holds command process niceness and resource limits, zero values mean
+// no change
+type limits struct {
+	Nice   int           // niceness, from -20 to 19
+	CPU    time.Duration // cpu time limit, rounded up to seconds
+	Memory uint64        // address space limit, bytes
+}
+
+func (l *limits) validate() error {
+	if l.Nice < -20 || l.Nice > 19 {
+		return fmt.Errorf("niceness %d is out of [-20, 19] range", l.Nice)
+	}
+	if l.CPU < 0 {
+		return fmt.Errorf("negative cpu limit")
+	}
+	if !limitsSupported {
+		return fmt.Errorf("process limits are not supported on this platform")
+	}
+	return nil
+}
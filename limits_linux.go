@@ -0,0 +1,96 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const limitsSupported = true
+
+// apply sets niceness and resource limits of the process with given pid, 0
+// meaning the calling one
+func (l *limits) apply(pid int) error {
+	if l.Nice != 0 {
+		if err := unix.Setpriority(unix.PRIO_PROCESS, pid, l.Nice); err != nil {
+			return err
+		}
+	}
+	if l.CPU > 0 {
+		sec := uint64((l.CPU + time.Second - 1) / time.Second)
+		if err := unix.Prlimit(pid, unix.RLIMIT_CPU, &unix.Rlimit{Cur: sec, Max: sec}, nil); err != nil {
+			return err
+		}
+	}
+	if l.Memory > 0 {
+		if err := unix.Prlimit(pid, unix.RLIMIT_AS, &unix.Rlimit{Cur: l.Memory, Max: l.Memory}, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wrap makes cmd run via limitExecCmd subcommand of ghwh itself, which
+// applies limits to its own process and then execs command, so that limits
+// are in effect before command starts
+func (l *limits) wrap(cmd *exec.Cmd) error {
+	if cmd.Err != nil {
+		return nil // command lookup failed, cmd.Start reports it
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd.Args = append([]string{self, limitExecCmd,
+		strconv.Itoa(l.Nice),
+		strconv.FormatInt(int64(l.CPU), 10),
+		strconv.FormatUint(l.Memory, 10),
+		cmd.Path}, cmd.Args...)
+	cmd.Path = self
+	return nil
+}
+
+// limitExecMain implements limitExecCmd subcommand, its arguments are
+// niceness, cpu limit in nanoseconds, memory limit, command path and command
+// argv
+func limitExecMain(args []string) {
+	if len(args) < 5 {
+		fmt.Fprintln(os.Stderr, "ghwh: malformed "+limitExecCmd+" arguments")
+		os.Exit(2)
+	}
+	var l limits
+	var err error
+	var cpu int64
+	if l.Nice, err = strconv.Atoi(args[0]); err == nil {
+		if cpu, err = strconv.ParseInt(args[1], 10, 64); err == nil {
+			l.Memory, err = strconv.ParseUint(args[2], 10, 64)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ghwh: malformed %s arguments: %v\n", limitExecCmd, err)
+		os.Exit(2)
+	}
+	l.CPU = time.Duration(cpu)
+	// niceness is per thread on Linux, so keep it on the thread calling exec
+	runtime.LockOSThread()
+	if err := l.apply(0); err != nil {
+		fmt.Fprintf(os.Stderr, "ghwh: setting process limits: %v\n", err)
+		os.Exit(126)
+	}
+	err = syscall.Exec(args[3], args[4:], os.Environ())
+	fmt.Fprintf(os.Stderr, "ghwh: %s: %v\n", args[3], err)
+	if errors.Is(err, fs.ErrNotExist) {
+		os.Exit(limitExecNotFound)
+	}
+	os.Exit(126)
+}
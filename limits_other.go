@@ -0,0 +1,21 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+const limitsSupported = false
+
+func (l *limits) wrap(cmd *exec.Cmd) error {
+	return errors.New("process limits are not supported on this platform")
+}
+
+func limitExecMain(args []string) {
+	fmt.Fprintln(os.Stderr, "ghwh: process limits are not supported on this platform")
+	os.Exit(126)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+)
+
+// listenerConfig describes single address server listens at
+type listenerConfig struct {
+	addr string
+	tls  bool
+}
+
+// parseListeners parses comma-separated list of addresses to listen at. Each
+// address may be prefixed with http:// or https:// to pick protocol
+// explicitly; addresses without prefix use TLS if certificate is configured.
+func parseListeners(list string, haveCert bool) ([]listenerConfig, error) {
+	var out []listenerConfig
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		l := listenerConfig{addr: s, tls: haveCert}
+		switch {
+		case strings.HasPrefix(s, "http://"):
+			l = listenerConfig{addr: strings.TrimPrefix(s, "http://")}
+		case strings.HasPrefix(s, "https://"):
+			l = listenerConfig{addr: strings.TrimPrefix(s, "https://"), tls: true}
+			if !haveCert {
+				return nil, errors.New(s + ": https requires -cert and -key")
+			}
+		}
+		if len(l.addr) == 0 {
+			return nil, errors.New("empty listen address")
+		}
+		out = append(out, l)
+	}
+	return out, nil
+}
+
+// limitListener returns listener accepting at most n simultaneous
+// connections: once n accepted connections are open, Accept waits until one
+// of them is closed
+func limitListener(ln net.Listener, n int) net.Listener {
+	return &limitedListener{Listener: ln, sem: make(chan struct{}, n), done: make(chan struct{})}
+}
+
+type limitedListener struct {
+	net.Listener
+	sem       chan struct{}
+	done      chan struct{} // closed by Close, to unblock waiting Accept
+	closeOnce sync.Once
+}
+
+func (l *limitedListener) Accept() (net.Conn, error) {
+	select {
+	case l.sem <- struct{}{}:
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+	c, err := l.Listener.Accept()
+	if err != nil {
+		<-l.sem
+		return nil, err
+	}
+	return &limitedConn{Conn: c, release: func() { <-l.sem }}, nil
+}
+
+func (l *limitedListener) Close() error {
+	err := l.Listener.Close()
+	l.closeOnce.Do(func() { close(l.done) })
+	return err
+}
+
+// limitedConn frees its limitedListener slot once closed
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
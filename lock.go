@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// lockPollInterval is how often lock file is checked while waiting for it
+const lockPollInterval = 500 * time.Millisecond
+
+// errLockHeld is returned by tryLock if lock is held by someone else
+var errLockHeld = errors.New("lock is held")
+
+// errLockRetry is returned by tryLock if lock file changed while acquiring
+// it, i.e. it was released or broken meanwhile, so it's worth retrying at once
+var errLockRetry = errors.New("lock file changed")
+
+// acquireLock takes lock file holding current process pid, waiting for lock
+// held by someone else until timeout passes (indefinitely if it's 0) or ctx
+// is done. If stale is positive, lock older than that is considered stale
+// and broken. It returns function releasing the lock.
+func acquireLock(ctx context.Context, name string, timeout, stale time.Duration) (func(), error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	pid := []byte(strconv.Itoa(os.Getpid()) + "\n")
+	for {
+		release, err := tryLock(name, pid, stale)
+		switch {
+		case err == nil:
+			return release, nil
+		case errors.Is(err, errLockRetry):
+			continue
+		case !errors.Is(err, errLockHeld):
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("lock %s is held by another run: %w", name, ctx.Err())
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+// lockAge returns age of lock for stale lock reports
+func lockAge(fi os.FileInfo) time.Duration {
+	return time.Since(fi.ModTime()).Round(time.Second)
+}
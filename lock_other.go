@@ -0,0 +1,44 @@
+//go:build !unix || aix
+
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"time"
+)
+
+// tryLock creates lock file exclusively. Without flock(2) there's no way to
+// tell whether lock holder is alive, so lock is only broken once it's older
+// than stale. Breaking is not atomic here: two waiters breaking the same stale
+// lock at once may both end up holding it.
+func tryLock(name string, pid []byte, stale time.Duration) (func(), error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err == nil {
+		_, err = f.Write(pid)
+		if err2 := f.Close(); err == nil {
+			err = err2
+		}
+		if err != nil {
+			os.Remove(name)
+			return nil, err
+		}
+		return func() { os.Remove(name) }, nil
+	}
+	if !errors.Is(err, os.ErrExist) {
+		return nil, err
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, errLockHeld // possibly just released, check again later
+	}
+	if stale <= 0 || time.Since(fi.ModTime()) <= stale {
+		return nil, errLockHeld
+	}
+	log.Printf("breaking stale lock %s: it is %v old", name, lockAge(fi))
+	if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return nil, errLockRetry
+}
@@ -0,0 +1,106 @@
+//go:build unix && !aix
+
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// tryLock takes lock file with flock(2), so lock held by a process is released
+// by the kernel once the process is gone, and jobs of this process holding
+// different locks don't mistake each other for a foreign process. Lock file
+// is removed on release, and lock held longer than stale is broken by
+// removing its file, so that next run locks a new one. Changes of the path
+// itself, verifying that locked file is still the one at the path, writing
+// pid, and removal, are serialized by flock on the lock file directory, so
+// that two waiters breaking the same stale lock can't remove lock one of them
+// has just taken.
+func tryLock(name string, pid []byte, stale time.Duration) (func(), error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		f.Close()
+		if !errors.Is(err, unix.EWOULDBLOCK) {
+			return nil, err
+		}
+		if stale > 0 {
+			if err := withDirLock(name, func() error { return breakStale(name, stale) }); err != nil {
+				return nil, err
+			}
+		}
+		return nil, errLockHeld
+	}
+	err = withDirLock(name, func() error {
+		if !samePath(f, name) {
+			return errLockRetry // released or broken after we opened it
+		}
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		_, err := f.WriteAt(pid, 0) // also refreshes lock age
+		return err
+	})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		if err := withDirLock(name, func() error {
+			if samePath(f, name) { // not broken meanwhile
+				return os.Remove(name)
+			}
+			return nil
+		}); err != nil {
+			log.Printf("lock %s release: %v", name, err)
+		}
+		f.Close()
+	}, nil
+}
+
+// breakStale removes lock file if it's older than stale. Must be called with
+// directory lock held.
+func breakStale(name string, stale time.Duration) error {
+	fi, err := os.Stat(name)
+	if err != nil || time.Since(fi.ModTime()) <= stale {
+		return nil // released meanwhile, or is not stale
+	}
+	log.Printf("breaking stale lock %s: it is %v old", name, lockAge(fi))
+	if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return errLockRetry
+}
+
+// samePath reports whether f is the file currently at path name
+func samePath(f *os.File, name string) bool {
+	fi1, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	fi2, err := os.Stat(name)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(fi1, fi2)
+}
+
+// withDirLock calls fn holding flock on directory of file name
+func withDirLock(name string, fn func() error) error {
+	d, err := os.Open(filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := unix.Flock(int(d.Fd()), unix.LOCK_EX); err != nil {
+		return err
+	}
+	return fn()
+}
@@ -1,232 +1,2840 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"hash"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/artyom/autoflags"
+	"github.com/expr-lang/expr/vm"
+	"github.com/santhosh-tekuri/jsonschema/v6"
 	yaml "gopkg.in/yaml.v2"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "sign" {
+		signMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == limitExecCmd {
+		limitExecMain(os.Args[2:])
+		return
+	}
 	config := struct {
-		Addr     string        `flag:"listen,address to listen at"`
+		Addr     string        `flag:"listen,comma-separated addresses to listen at, http:// or https:// prefix forces protocol"`
+		Network  string        `flag:"net,network to listen on: tcp, tcp4 or tcp6"`
 		Qsize    int           `flag:"qsize,job queue size"`
+		SpillDir string        `flag:"spill-dir,directory to keep jobs in when queue is full, instead of rejecting them (disabled if empty)"`
+		NoSpill  bool          `flag:"no-spillover,when queue is full, make deliveries wait for a free slot instead of rejecting them"`
+		QueueDir string        `flag:"queue-dir,directory to keep queued jobs in until they are run, to replay them after crash or restart (disabled if empty)"`
+		SpillMax int           `flag:"spill-max,maximum number of jobs kept in -spill-dir"`
+		Sched    string        `flag:"sched,job scheduling: fifo, or fair to alternate between endpoints"`
 		Config   string        `flag:"config,path to config (yaml)"`
+		Watch    bool          `flag:"watch,reload config automatically when its file changes"`
+		PrintCfg bool          `flag:"print-config,print effective config with secrets redacted and exit"`
+		Debug    bool          `flag:"debug-server,ignore config and log details of every request received, to help setting up webhooks"`
+		DebugKey string        `flag:"debug-secret,secret to check signatures against in -debug-server mode (GHWH_SECRET environment variable if empty)"`
+		Allowed  string        `flag:"allowed-commands,comma-separated list of commands config may run, either paths or names looked up in PATH (any if empty)"`
+		Runner   string        `flag:"runner,command prefix to run all commands with, i.e. \"sudo -u deploy\" (split on spaces)"`
+		OnStart  string        `flag:"startup-command,command to run once server starts listening (split on spaces)"`
+		OnStop   string        `flag:"shutdown-command,command to run on shutdown, before server stops accepting deliveries (split on spaces)"`
 		CertFile string        `flag:"cert,path to ssl certificate"`
 		KeyFile  string        `flag:"key,path to ssl certificate key"`
+		TLSMin   string        `flag:"tls-min,minimum TLS version: 1.0, 1.1, 1.2 or 1.3"`
+		Ciphers  string        `flag:"tls-ciphers,comma-separated list of allowed TLS 1.0-1.2 cipher suites (Go defaults if empty)"`
+		ClientCA string        `flag:"client-ca,path to CA certificates (pem) to verify TLS client certificates against"`
 		Timeout  time.Duration `flag:"timeout,timeout for command run"`
 		Verbose  bool          `flag:"verbose,pass stdout/stderr from commands to stderr"`
+		Raw      bool          `flag:"raw-output,with -verbose, pass command output as is instead of logging it line by line"`
+		LineWait time.Duration `flag:"output-line-timeout,with -verbose, log incomplete output line once it's pending this long, i.e. progress output (0 waits for line end)"`
+		RefCheck string        `flag:"ref-check,handling of refs that are not branches or tags or have unusual characters: off, log or reject"`
+		Encoding string        `flag:"output-encoding,handling of invalid UTF-8 in logged command output: raw, replace or escape"`
+		Unknown  bool          `flag:"log-unknown-top-level-keys,debug: log top-level payload keys ghwh does not use"`
+		Quiet    bool          `flag:"quiet,only log warnings and errors"`
+		LogPath  bool          `flag:"log-endpoint,prefix job log lines with endpoint path, to tell apart endpoints of the same repository"`
+		IOConc   int           `flag:"max-io-concurrency,maximum total ioweight of endpoint commands running at once (0 means no limit)"`
+		MaxConns int           `flag:"max-conns,maximum number of simultaneous connections per listen address (0 means no limit)"`
+		Idle     time.Duration `flag:"idle-timeout,time to keep idle keep-alive connections open (0 means the server read timeout)"`
+		NoKeep   bool          `flag:"no-keepalive,disable HTTP keep-alives, closing connection after each request"`
+		Drain    time.Duration `flag:"drain-timeout,on shutdown, time to wait for queued jobs to complete (0 means no limit)"`
+		Recycle  time.Duration `flag:"worker-recycle,replace worker goroutines with fresh ones once idle after this time (0 disables)"`
+		Admin    string        `flag:"admin,address to serve admin API at (disabled if empty)"`
+		AdminTok string        `flag:"admin-token,bearer token required by admin API calls changing state (these are disabled if empty)"`
+		Pprof    bool          `flag:"pprof,serve profiling data at /debug/pprof/ of admin API"`
+		WarnAge  time.Duration `flag:"warn-secret-age,warn daily about endpoint secrets rotated longer than this ago (0 disables)"`
+		BodyTime time.Duration `flag:"body-timeout,time limit to read and verify request body (0 means only server read timeout applies)"`
+		MaxBody  int64         `flag:"max-body,maximum request body size in bytes, larger deliveries are rejected with 413 status (0 means no limit)"`
+		NeedLen  bool          `flag:"require-content-length,reject requests without Content-Length header, including chunked ones"`
+		SigDiag  string        `flag:"signature-diagnostics,directory to save requests failing signature check to, logging likely reasons (disabled if empty)"`
 	}{
-		Addr:    "127.0.0.1:8080",
-		Qsize:   10,
-		Timeout: 3 * time.Minute,
+		Addr:     "127.0.0.1:8080",
+		Network:  "tcp",
+		TLSMin:   "1.2",
+		Qsize:    10,
+		SpillMax: 1000,
+		Sched:    "fifo",
+		Encoding: "raw",
+		RefCheck: "off",
+		Timeout:  3 * time.Minute,
+		Drain:    time.Minute,
+		BodyTime: 5 * time.Second,
+		MaxBody:  maxPayloadSize,
 	}
 	autoflags.Define(&config)
 	flag.Parse()
-	cfg, err := readConfig(config.Config)
+	switch config.Network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		log.Fatalf("unsupported network %q", config.Network)
+	}
+	if config.NoSpill && len(config.SpillDir) > 0 {
+		log.Fatal("-no-spillover and -spill-dir cannot be used together")
+	}
+	if config.Sched != "fifo" && config.Sched != "fair" {
+		log.Fatalf("unsupported scheduling %q", config.Sched)
+	}
+	switch config.RefCheck {
+	case "off", "log", "reject":
+	default:
+		log.Fatalf("unsupported ref check mode %q", config.RefCheck)
+	}
+	switch config.Encoding {
+	case "raw", "replace", "escape":
+	default:
+		log.Fatalf("unsupported output encoding %q", config.Encoding)
+	}
+	if config.Debug {
+		if config.DebugKey == "" {
+			config.DebugKey = os.Getenv("GHWH_SECRET")
+		}
+		if err := debugServer(config.Network, config.Addr, config.DebugKey); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	allowed := newCommandPolicy(config.Allowed)
+	if err := allowed.checkFlags(map[string]string{
+		"runner":           config.Runner,
+		"startup-command":  config.OnStart,
+		"shutdown-command": config.OnStop,
+	}); err != nil {
+		log.Fatal(err)
+	}
+	var cfg map[string]endpoint
+	var err error
+	if len(config.Config) > 0 {
+		cfg, err = readConfig(config.Config, allowed)
+	} else {
+		cfg, err = envConfig(allowed)
+	}
+	if err == nil {
+		err = checkClientCerts(cfg, len(config.ClientCA) > 0)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
+	if config.PrintCfg {
+		b, err := compactYAML(redactedConfig(cfg))
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Stdout.Write(b)
+		return
+	}
 	if config.Qsize < 1 {
 		config.Qsize = 1
 	}
-	h := hookHandler{
-		cmds:    make(chan execEnv, config.Qsize),
-		timeout: config.Timeout,
-		verbose: config.Verbose,
+	base, kill := context.WithCancel(context.Background())
+	h := &hookHandler{
+		queue:     newJobQueue(config.Qsize, config.Sched == "fair"),
+		timeout:   config.Timeout,
+		verbose:   config.Verbose,
+		rawOutput: config.Raw,
+		outputEnc: config.Encoding,
+		refCheck:  config.RefCheck,
+		lineWait:  config.LineWait,
+		logKeys:   config.Unknown,
+		readBody:  config.BodyTime,
+		needLen:   config.NeedLen,
+		maxBody:   config.MaxBody,
+		recycle:   config.Recycle,
+		runner:    strings.Fields(config.Runner),
+		allowed:   allowed,
+		clientCA:  len(config.ClientCA) > 0,
+		quiet:     config.Quiet,
+		block:     config.NoSpill,
+		logPath:   config.LogPath,
+		base:      base,
+		kill:      kill,
+		drain:     make(chan struct{}),
+		done:      make(chan struct{}),
+		stats:     newStatsRegistry(),
+		metrics:   newMetrics(),
+		deployed:  newDeployLog(),
+		adminTok:  config.AdminTok,
+		pprof:     config.Pprof,
 	}
-	for k, v := range cfg {
-		http.HandleFunc(k, h.endpointHandler(v))
+	if len(config.SpillDir) > 0 {
+		if h.spill, err = newSpillQueue(config.SpillDir, config.SpillMax); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(config.SigDiag) > 0 {
+		h.sigDiag = newDiagStore(config.SigDiag)
+	}
+	if config.IOConc > 0 {
+		h.ioSem = newIOSemaphore(config.IOConc)
+	}
+	if len(config.QueueDir) > 0 {
+		if h.journal, err = newJobJournal(config.QueueDir); err != nil {
+			log.Fatal(err)
+		}
+		// both keep jobs as .job files, sharing directory would make
+		// spilled jobs replayed as journaled ones
+		if h.spill != nil && sameDir(config.QueueDir, config.SpillDir) {
+			log.Fatal("-queue-dir and -spill-dir must be different directories")
+		}
+	}
+	h.configure(cfg)
+	if config.WarnAge > 0 {
+		go h.warnSecretAge(config.WarnAge)
 	}
 	go h.run()
-	server := &http.Server{
-		Addr:           config.Addr,
-		MaxHeaderBytes: 1 << 20,
-		ReadTimeout:    15 * time.Second,
-		WriteTimeout:   15 * time.Second,
+	if config.Watch {
+		if len(config.Config) == 0 {
+			log.Fatal("-watch requires -config")
+		}
+		if err := h.watchConfig(config.Config); err != nil {
+			log.Fatal(err)
+		}
+	}
+	ctl := make(chan os.Signal, 1)
+	signal.Notify(ctl, append(reloadSignals, dumpSignals...)...)
+	go func() {
+		for sig := range ctl {
+			if isDumpSignal(sig) {
+				h.dump()
+				continue
+			}
+			if err := h.reload(config.Config); err != nil {
+				log.Printf("config reload: %v", err)
+				continue
+			}
+			log.Printf("config reloaded on %v", sig)
+		}
+	}()
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	// replay before accepting deliveries, so that replayed jobs run before
+	// new ones; with signals already handled, shutdown requested meanwhile
+	// stops it, leaving jobs not yet queued in journal
+	replayCtx, stopReplay := context.WithCancel(h.base)
+	replayed := make(chan struct{})
+	go func() { h.replayJournal(replayCtx); close(replayed) }()
+	select {
+	case <-replayed:
+		stopReplay()
+	case sig := <-sigCh:
+		stopReplay()
+		<-replayed
+		log.Printf("got %v during journal replay, shutting down", sig)
+		h.shutdown(config.Drain)
+		return
+	}
+	useTLS := len(config.CertFile) > 0 && len(config.KeyFile) > 0
+	listeners, err := parseListeners(config.Addr, useTLS)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var tlsConf *tls.Config
+	if useTLS {
+		if tlsConf, err = tlsConfig(config.TLSMin, config.Ciphers); err != nil {
+			log.Fatal(err)
+		}
+		if len(config.ClientCA) > 0 {
+			if tlsConf.ClientCAs, err = certPool(config.ClientCA); err != nil {
+				log.Fatal(err)
+			}
+			// certificate is optional at TLS level, endpoints that
+			// require it check it themselves
+			tlsConf.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	} else if len(config.ClientCA) > 0 {
+		log.Fatal("-client-ca requires -cert and -key")
+	}
+	servers := make([]*http.Server, len(listeners))
+	lns := make([]net.Listener, len(listeners))
+	for i, l := range listeners {
+		servers[i] = &http.Server{
+			Addr:           l.addr,
+			Handler:        h,
+			MaxHeaderBytes: 1 << 20,
+			ReadTimeout:    15 * time.Second,
+			WriteTimeout:   serverWriteTimeout,
+			IdleTimeout:    config.Idle,
+		}
+		if config.NoKeep {
+			servers[i].SetKeepAlivesEnabled(false)
+		}
+		if l.tls {
+			servers[i].TLSConfig = tlsConf.Clone()
+		}
+		ln, err := net.Listen(config.Network, l.addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if config.MaxConns > 0 {
+			ln = limitListener(ln, config.MaxConns)
+		}
+		lns[i] = ln
+	}
+	srvErr := make(chan error, len(servers)+1)
+	var admin *http.Server
+	if len(config.Admin) > 0 {
+		admin = &http.Server{
+			Addr:         config.Admin,
+			Handler:      h.adminHandler(),
+			ReadTimeout:  15 * time.Second,
+			WriteTimeout: 15 * time.Second,
+		}
+		if config.Pprof {
+			// leave room for CPU profile of default 30 seconds
+			admin.WriteTimeout = time.Minute
+		}
+		go func() { srvErr <- admin.ListenAndServe() }()
+	} else if config.Pprof {
+		log.Fatal("-pprof requires -admin")
+	}
+	for i, server := range servers {
+		go func() {
+			if listeners[i].tls {
+				srvErr <- server.ServeTLS(lns[i], config.CertFile, config.KeyFile)
+				return
+			}
+			srvErr <- server.Serve(lns[i])
+		}()
+	}
+	sdNotify("READY=1")
+	sdWatchdog()
+	if len(config.OnStart) > 0 {
+		go h.runLifecycle("startup", config.OnStart)
+	}
+	select {
+	case err := <-srvErr:
+		log.Fatal(err)
+	case sig := <-sigCh:
+		log.Printf("got %v, shutting down", sig)
 	}
-	if len(config.CertFile) > 0 && len(config.KeyFile) > 0 {
-		log.Fatal(server.ListenAndServeTLS(config.CertFile, config.KeyFile))
+	sdNotify("STOPPING=1")
+	if len(config.OnStop) > 0 {
+		h.runLifecycle("shutdown", config.OnStop)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), servers[0].WriteTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				log.Printf("server %s shutdown: %v", server.Addr, err)
+			}
+		}()
+	}
+	wg.Wait()
+	h.shutdown(config.Drain)
+	if admin != nil {
+		admin.Shutdown(ctx)
 	}
-	log.Fatal(server.ListenAndServe())
 }
 
 // hookHandler manages receiving/dispatching hook requests and running
 // corresponding commands
 type hookHandler struct {
-	cmds    chan execEnv
-	timeout time.Duration
-	verbose bool
-}
-
-// run receives commands to run on channel and executes them
-func (hh hookHandler) run() {
-	cmdRun := func(item execEnv) error {
-		ctx := context.Background()
-		if hh.timeout > 0 {
-			var cancel func()
-			ctx, cancel = context.WithTimeout(ctx, hh.timeout)
-			defer cancel()
+	queue     *jobQueue
+	spill     *spillQueue // overflow of queue kept on disk, if enabled
+	journal   *jobJournal // copies of queued jobs kept on disk until run, if enabled
+	timeout   time.Duration
+	verbose   bool
+	rawOutput bool          // with verbose, pass output as is instead of logging lines
+	outputEnc string        // handling of invalid UTF-8 in output: raw, replace or escape
+	lineWait  time.Duration // if positive, incomplete output lines are logged after it
+	sigDiag   *diagStore    // saves requests with signature mismatch, if set
+	refCheck  string        // handling of suspicious refs: off, log or reject
+	logKeys   bool          // log unknown top-level payload keys
+	readBody  time.Duration // time limit to read and verify request body
+	needLen   bool          // require Content-Length, reject chunked requests
+	maxBody   int64         // if positive, limits request body size
+	recycle   time.Duration // if positive, idle workers are replaced after it
+	runner    []string      // prefix of all commands, unless endpoint sets its own
+	allowed   commandPolicy // commands reloaded config may run
+	clientCA  bool          // -client-ca is set, client certificates can be verified
+	quiet     bool          // suppress informational logs
+	block     bool          // wait for free queue slot instead of rejecting delivery
+	logPath   bool          // prefix job log lines with endpoint path
+
+	base    context.Context // parent of all command contexts
+	kill    func()          // cancels base, killing running command
+	drain   chan struct{}   // closed on shutdown, run returns once queue empty
+	done    chan struct{}   // closed when run returns
+	stats   *statsRegistry
+	metrics *metrics
+	health  healthCache
+
+	deployed *deployLog // last deployed commits, for endpoints skipping redeploys
+
+	adminTok string // token to authorize state-changing admin calls
+	pprof    bool   // serve profiling data on admin API
+
+	mu     sync.RWMutex
+	mux    *http.ServeMux       // routes requests to endpoint handlers
+	cfg    map[string]endpoint  // config mux was built from
+	paused map[string]bool      // endpoints whose jobs are skipped, by path
+	queues map[string]*jobQueue // dedicated endpoint queues, by path
+	// deliveries accumulated for endpoints with batch interval, by path
+	batches map[string]*batch
+
+	busy  busySet      // repositories with jobs in progress, for RejectBusy endpoints
+	ioSem *ioSemaphore // limits I/O heavy commands running at once, if set
+
+	stopped bool           // set once main worker returns, no new workers then
+	workers sync.WaitGroup // workers of dedicated queues
+}
+
+// ServeHTTP implements http.Handler, routing requests to handlers of currently
+// configured endpoints
+func (hh *hookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hh.mu.RLock()
+	mux := hh.mux
+	hh.mu.RUnlock()
+	mux.ServeHTTP(w, r)
+}
+
+// configure replaces set of served endpoints with those from cfg, resizing
+// dedicated queues of endpoints whose queue size changed
+func (hh *hookHandler) configure(cfg map[string]endpoint) {
+	mux := http.NewServeMux()
+	for k, v := range cfg {
+		if k == defaultEndpoint {
+			k = "/"
+		}
+		if v.Enabled != nil && !*v.Enabled {
+			mux.Handle(k, disabledHandler(v))
+			continue
+		}
+		mux.HandleFunc(k, hh.endpointHandler(v))
+	}
+	hh.mu.Lock()
+	defer hh.mu.Unlock()
+	hh.mux, hh.cfg = mux, cfg
+	for _, ep := range cfg {
+		if q, ok := hh.queues[ep.path]; ok && ep.QueueSize > 0 && q.resize(ep.QueueSize) {
+			log.Printf("%s: dedicated queue resized to %d", ep.path, ep.QueueSize)
+		}
+	}
+}
+
+// disabledHandler returns handler rejecting all requests to disabled endpoint
+func disabledHandler(ep endpoint) http.HandlerFunc {
+	code := ep.DisabledStatus
+	if code == 0 {
+		code = http.StatusServiceUnavailable
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "endpoint is disabled", code)
+	}
+}
+
+// reload reads config from file and replaces served endpoints with the ones
+// from it. If config cannot be loaded, previous one is kept. Jobs already
+// queued are not affected: each carries a copy of its endpoint config, so it
+// runs as configured at delivery time even if endpoint is changed or removed.
+// Only jobs spilled to disk, and journaled jobs replayed on start, look their
+// endpoint up in config, and are dropped if it's gone.
+func (hh *hookHandler) reload(fileName string) error {
+	if len(fileName) == 0 {
+		return errors.New("no config file to reload")
+	}
+	cfg, err := readConfig(fileName, hh.allowed)
+	if err != nil {
+		return err
+	}
+	if err := checkClientCerts(cfg, hh.clientCA); err != nil {
+		return err
+	}
+	hh.configure(cfg)
+	return nil
+}
+
+// dump logs current config with secrets redacted and per-endpoint stats
+func (hh *hookHandler) dump() {
+	hh.mu.RLock()
+	cfg := hh.cfg
+	hh.mu.RUnlock()
+	if b, err := compactYAML(redactedConfig(cfg)); err == nil {
+		log.Printf("current config:\n%s", b)
+	} else {
+		log.Printf("config dump: %v", err)
+	}
+	log.Printf("queued jobs: %d", hh.queued())
+	snap := hh.stats.snapshot()
+	keys := make([]string, 0, len(snap))
+	for k := range snap {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		st := snap[k]
+		log.Printf("%s: accepted: %d, runs: %d, failures: %d",
+			k, st.Accepted, st.Runs, st.Failures)
+	}
+}
+
+// infof logs informational message unless handler is configured to be quiet
+func (hh *hookHandler) infof(format string, v ...interface{}) {
+	if hh.quiet {
+		return
+	}
+	log.Printf(format, v...)
+}
+
+// setPaused pauses or resumes endpoint with given path; it reports false if
+// there's no such endpoint configured
+func (hh *hookHandler) setPaused(path string, pause bool) bool {
+	hh.mu.Lock()
+	defer hh.mu.Unlock()
+	if _, ok := hh.cfg[path]; !ok {
+		return false
+	}
+	if hh.paused == nil {
+		hh.paused = make(map[string]bool)
+	}
+	if pause {
+		hh.paused[path] = true
+	} else {
+		delete(hh.paused, path)
+	}
+	return true
+}
+
+// jobPrefix returns log line prefix identifying the job by its repository,
+// ref and request id, and by endpoint path if -log-endpoint is set
+func (hh *hookHandler) jobPrefix(item execEnv) string {
+	s := fmt.Sprintf("repo: %q, ref: %q, id: %q, ",
+		item.payload.Repository.Name, item.payload.Ref, item.requestID)
+	if hh.logPath {
+		s = fmt.Sprintf("endpoint: %q, ", item.endpoint.path) + s
+	}
+	return s
+}
+
+// serverWriteTimeout is write timeout of servers handling deliveries; it
+// counts from the time request headers are read
+const serverWriteTimeout = 15 * time.Second
+
+// responseMargin is time left for writing response when delivery waits for a
+// free queue slot with -no-spillover, so that it's written before server write
+// timeout
+const responseMargin = time.Second
+
+// push adds job to q honoring its per-ref limit, returning job dropped to
+// make room for it, if any, see jobQueue.pushRef. With -no-spillover it waits
+// for a free slot while q is full, until ctx is done.
+func (hh *hookHandler) push(ctx context.Context, q *jobQueue, job execEnv) (*execEnv, error) {
+	return q.pushRef(ctx, job, hh.block)
+}
+
+// enqueue adds already journaled job to q, see push. If q is the main queue
+// and it's full, job is spilled to disk when -spill-dir is set; once there
+// are jobs spilled to disk, new ones are spilled too, so that jobs still run
+// in order they were received. If job is not queued, its journal entry is
+// removed and errRefLimit, errQueueFull or spill queue error is returned.
+func (hh *hookHandler) enqueue(ctx context.Context, q *jobQueue, job execEnv) error {
+	spill := q == hh.queue && hh.spill != nil
+	err := errQueueFull
+	if !(spill && hh.spill.len() > 0) && q != nil {
+		var dropped *execEnv
+		dropped, err = hh.push(ctx, q, job)
+		if dropped != nil {
+			log.Printf("%ssuperseded by %q, dropping queued job", hh.jobPrefix(*dropped), job.requestID)
+			hh.journal.remove(*dropped)
+			hh.busy.release(busyKey(*dropped))
 		}
-		var cmd *exec.Cmd
-		c, ok := item.endpoint.Refs[item.payload.Ref]
+	}
+	if err == nil {
+		return nil
+	}
+	hh.journal.remove(job)
+	if err != errQueueFull || !spill {
+		return err
+	}
+	if err := hh.spill.push(job); err != nil {
+		return err
+	}
+	hh.infof("id: %q, queue is full, job spilled to disk", job.requestID)
+	return nil
+}
+
+// isPaused reports whether endpoint with given path is paused
+func (hh *hookHandler) isPaused(path string) bool {
+	hh.mu.RLock()
+	defer hh.mu.RUnlock()
+	return hh.paused[path]
+}
+
+// errDeferred is returned by runJob for job postponed until its endpoint
+// schedule allows it to run
+var errDeferred = errors.New("job deferred")
+
+// runJob runs command of a single job
+func (hh *hookHandler) runJob(item execEnv) (err error) {
+	if sc := item.endpoint.AllowedSchedule; sc != nil {
+		now := time.Now()
 		switch {
-		case ok:
-			log.Print("found per-ref command")
-			cmd = exec.CommandContext(ctx, c.Command, c.Args...)
-		case !ok && len(item.endpoint.Command) > 0:
-			log.Print("found global per-repo command")
-			cmd = exec.CommandContext(ctx,
-				item.endpoint.Command,
-				item.endpoint.Args...)
+		case sc.allows(now):
+		case sc.Defer:
+			next := sc.next(now)
+			log.Printf("%soutside of allowed schedule, deferred until %v", hh.jobPrefix(item), next)
+			time.AfterFunc(next.Sub(now), func() {
+				if q := hh.queueFor(item.endpoint); q == nil || !q.push(item) {
+					log.Printf("%squeue is full, dropping deferred job", hh.jobPrefix(item))
+					hh.journal.remove(item)
+					hh.busy.release(busyKey(item))
+				}
+			})
+			return errDeferred
 		default:
-			log.Printf("no matching command for ref %q found, skipping",
+			log.Printf("%soutside of allowed schedule, skipping", hh.jobPrefix(item))
+			return nil
+		}
+	}
+	if pr := item.payload.PullRequest; item.endpoint.MergedOnly && pr != nil &&
+		!(item.payload.Action == "closed" && pr.Merged) {
+		hh.infof("%spull request #%d is not merged, skipping", hh.jobPrefix(item), pr.Number)
+		return nil
+	}
+	if item.endpoint.RequireCommits && item.event == "push" && len(item.payload.Commits) == 0 {
+		hh.infof("%spush has no commits, skipping", hh.jobPrefix(item))
+		return nil
+	}
+	if p := item.endpoint.when; p != nil {
+		ok, err := evalExpr(p, item)
+		if err != nil {
+			return fmt.Errorf("when: %w", err)
+		}
+		if !ok {
+			hh.infof("%swhen expression is false, skipping", hh.jobPrefix(item))
+			return nil
+		}
+	}
+	rt, routed, err := matchRoute(item)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := hh.context()
+	defer cancel()
+	var name string
+	var args []string
+	c, ok := item.endpoint.refRule(item.payload.Ref)
+	switch {
+	case routed:
+		hh.infof("found routed command")
+		name, args = argv(rt.Exec, rt.Command, rt.Args)
+	case len(item.endpoint.Dispatcher) > 0:
+		if name, args, err = hh.dispatch(item); err != nil {
+			return err
+		}
+		if len(name) == 0 {
+			hh.infof("dispatcher returned no command for ref %q, skipping",
 				item.payload.Ref)
 			return nil
 		}
-		log.Printf("repo: %q, ref: %q, command: %v",
-			item.endpoint.RepoName, item.payload.Ref, cmd.Args)
-		if hh.verbose {
-			cmd.Stdout = os.Stderr
-			cmd.Stderr = os.Stderr
+		if !hh.allowed.allows(name) {
+			return fmt.Errorf("dispatched command %q is not allowed", name)
+		}
+		hh.infof("found dispatched command")
+	case ok:
+		hh.infof("found per-ref command")
+		name, args = argv(c.Exec, c.Command, c.Args)
+	case !ok && (len(item.endpoint.Command) > 0 || len(item.endpoint.Exec) > 0) &&
+		item.endpoint.globalAllowed(item.payload.Ref):
+		hh.infof("found global per-repo command")
+		name, args = argv(item.endpoint.Exec,
+			item.endpoint.Command, item.endpoint.Args)
+	default:
+		hh.infof("no matching command for ref %q found, skipping",
+			item.payload.Ref)
+		return nil
+	}
+	name, args = withPrefix(hh.runnerFor(item.endpoint), name, args)
+	cmd := exec.CommandContext(ctx, name, args...)
+	if sha := item.payload.After; item.endpoint.SkipDeployed && len(sha) > 0 {
+		ok, err := hh.deployed.deployed(item.endpoint, item.payload.Ref, sha)
+		if err != nil {
+			return fmt.Errorf("loading deployed commits: %w", err)
+		}
+		if ok {
+			log.Printf("%scommit %s is already deployed, skipping", hh.jobPrefix(item), sha)
+			return nil
+		}
+	}
+	if d := item.endpoint.Delay; d > 0 {
+		hh.infof("%sdelaying command by %v", hh.jobPrefix(item), d)
+		t := time.NewTimer(d)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return fmt.Errorf("waiting for delay: %w", ctx.Err())
+		}
+	}
+	hh.infof("%scommand: %v", hh.jobPrefix(item), cmd.Args)
+	cmd.Env = item.environ()
+	if item.endpoint.TempDir {
+		dir, err := os.MkdirTemp("", "ghwh-")
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := os.RemoveAll(dir); err != nil {
+				log.Printf("temporary directory cleanup: %v", err)
+			}
+		}()
+		cmd.Dir = dir
+		cmd.Env = append(cmd.Env, "GHWH_TMPDIR="+dir)
+	}
+	if item.endpoint.PayloadFile {
+		name, err := writePayloadFile(item.body)
+		if err != nil {
+			return fmt.Errorf("writing payload file: %w", err)
+		}
+		defer func() {
+			if err := os.Remove(name); err != nil {
+				log.Printf("payload file cleanup: %v", err)
+			}
+		}()
+		cmd.Env = append(cmd.Env, "GHWH_PAYLOAD_FILE="+name)
+	}
+	switch {
+	case len(item.endpoint.LogFile) > 0:
+		f, err := os.OpenFile(item.endpoint.LogFile,
+			os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fmt.Fprintf(f, "# %s %scommand: %v\n",
+			time.Now().Format(time.RFC3339), hh.jobPrefix(item), cmd.Args)
+		max := item.endpoint.MaxOutput
+		if max <= 0 {
+			max = defaultMaxOutput
+		}
+		// same writer for both streams, so that exec shares one
+		// pipe and output is not interleaved mid-line
+		var w io.Writer = &limitWriter{w: f, n: max}
+		if hh.outputEnc != "raw" {
+			uw := &utf8Writer{w: w, enc: hh.outputEnc}
+			defer uw.Flush()
+			w = uw
+		}
+		cmd.Stdout, cmd.Stderr = w, w
+	case hh.verbose && hh.rawOutput:
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+	case hh.verbose:
+		prefix := hh.jobPrefix(item)
+		stdout := &lineWriter{prefix: prefix + "stdout: ", enc: hh.outputEnc, wait: hh.lineWait}
+		stderr := &lineWriter{prefix: prefix + "stderr: ", enc: hh.outputEnc, wait: hh.lineWait}
+		defer stdout.Flush()
+		defer stderr.Flush()
+		cmd.Stdout, cmd.Stderr = stdout, stderr
+	}
+	if u := item.endpoint.Callback; len(u) > 0 {
+		var tail *tailWriter
+		if n := item.endpoint.CallbackOutput; n > 0 {
+			tail = &tailWriter{n: n}
+			if cmd.Stdout == cmd.Stderr {
+				w := teeWriter(cmd.Stdout, tail)
+				cmd.Stdout, cmd.Stderr = w, w
+			} else {
+				cmd.Stdout, cmd.Stderr = teeWriter(cmd.Stdout, tail), teeWriter(cmd.Stderr, tail)
+			}
+		}
+		start := time.Now()
+		defer func() {
+			var output string
+			if err != nil && tail != nil {
+				output = tail.String()
+			}
+			go callback(item, err, time.Since(start), output)
+		}()
+	}
+	if lf := item.endpoint.LockFile; len(lf) > 0 {
+		release, err := acquireLock(ctx, lf, item.endpoint.LockTimeout, item.endpoint.LockStale)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+	if n := item.endpoint.IOWeight; n > 0 && hh.ioSem != nil {
+		if err := hh.ioSem.acquire(ctx, n); err != nil {
+			return fmt.Errorf("waiting for I/O slot: %w", err)
+		}
+		defer hh.ioSem.release(n)
+	}
+	if l := item.endpoint.Limits; l != nil {
+		if err := l.wrap(cmd); err != nil {
+			return fmt.Errorf("setting process limits: %v", err)
+		}
+	}
+	if item.endpoint.PTY {
+		wait, err := startPTY(cmd)
+		if err != nil {
+			return startError(name, err)
+		}
+		defer wait()
+	} else if err := cmd.Start(); err != nil {
+		return startError(name, err)
+	}
+	if err := classifyExit(ctx, cmd.Wait()); err != nil {
+		var ee *exitError
+		if item.endpoint.Limits != nil && errors.As(err, &ee) &&
+			ee.kind == "exit" && ee.code == limitExecNotFound {
+			return startError(name, fs.ErrNotExist)
 		}
-		return cmd.Run()
+		return err
 	}
-	for item := range hh.cmds {
-		if err := cmdRun(item); err != nil {
-			log.Printf("repo: %q, ref: %q, command run: %v",
-				item.endpoint.RepoName, item.payload.Ref, err)
+	if item.endpoint.SkipDeployed && len(item.payload.After) > 0 {
+		if err := hh.deployed.record(item.endpoint, item.payload.Ref,
+			item.payload.After); err != nil {
+			log.Printf("%s: saving deployed commit: %v", item.endpoint.path, err)
 		}
 	}
+	if err := hh.markDeployed(item); err != nil {
+		log.Printf("%s: writing marker file: %v", item.endpoint.path, err)
+	}
+	return nil
 }
 
-// endpointHandler constructs http.HandlerFunc for particular endpoint
-func (hh hookHandler) endpointHandler(ep endpoint) http.HandlerFunc {
-	secret := []byte(ep.Secret)
-	withSecret := len(ep.Secret) > 0
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
-			http.Error(w, "unsupported method",
-				http.StatusMethodNotAllowed)
-			return
-		}
-		switch r.Header.Get("X-Github-Event") {
-		case "push":
-		case "ping":
-			return // accept with code 200
-		default:
-			http.Error(w, "unsupported event type",
-				http.StatusBadRequest)
-			return
+// process runs job and records its outcome in stats and metrics. Journal
+// entry of the job is removed once it's processed, unless job is deferred or
+// interrupted by shutdown. Deferred job keeps its busy mark, see rejectbusy,
+// until it's processed again.
+func (hh *hookHandler) process(item execEnv) {
+	var keep, deferred bool
+	defer func() {
+		if !keep {
+			hh.journal.remove(item)
 		}
-		if r.Header.Get("Content-Type") != "application/json" {
-			http.Error(w, "unsupported content type",
-				http.StatusUnsupportedMediaType)
-			return
+		if item.endpoint.RejectBusy && !deferred {
+			hh.busy.release(busyKey(item))
 		}
-		var sig string
-		if n, err := fmt.Sscanf(
-			r.Header.Get("X-Hub-Signature"),
-			"sha1=%s", &sig); n != 1 || err != nil {
-			http.Error(w, "malformed signature", http.StatusForbidden)
+	}()
+	if hh.isPaused(item.endpoint.path) {
+		log.Printf("%sendpoint %s is paused, skipping", hh.jobPrefix(item), item.endpoint.path)
+		hh.stats.update(item.endpoint.path, func(st *endpointStats) { st.Skipped++ })
+		hh.metrics.inc("ghwh_runs_total", metricLabels(item.endpoint,
+			item.event, item.payload.Ref, "result", "paused")...)
+		return
+	}
+	err := hh.runJob(item)
+	if err == errDeferred {
+		keep, deferred = true, true // queued again once schedule allows
+		return
+	}
+	var ee *exitError
+	isExit := errors.As(err, &ee)
+	// job interrupted by shutdown is run again on the next start
+	keep = err != nil && hh.base.Err() != nil && hh.journal != nil
+	hh.stats.update(item.endpoint.path, func(st *endpointStats) {
+		st.Runs++
+		if err == nil {
+			st.LastError, st.LastErrorTime = "", nil
+			st.LastExitCode = new(int)
 			return
 		}
-		var (
-			tr      io.Reader = r.Body
-			mac     hash.Hash
-			payload pushPayload
-		)
-		if withSecret {
-			mac = hmac.New(sha1.New, secret)
-			tr = io.TeeReader(r.Body, mac)
+		st.Failures++
+		now := time.Now()
+		st.LastError, st.LastErrorTime = err.Error(), &now
+		st.LastExitCode = nil // command didn't start or exit on its own
+		if isExit {
+			st.LastExitCode = &ee.code
 		}
-		if err := json.NewDecoder(tr).Decode(&payload); err != nil {
-			log.Print(err)
-			http.Error(w, "malformed json",
-				http.StatusInternalServerError)
+	})
+	result := "ok"
+	switch {
+	case isExit:
+		result = ee.kind
+	case errors.Is(err, errNotFound):
+		result = "notfound"
+	case err != nil:
+		result = "error"
+	}
+	if err != nil {
+		log.Printf("%scommand run: %v", hh.jobPrefix(item), err)
+	}
+	hh.metrics.inc("ghwh_runs_total", metricLabels(item.endpoint,
+		item.event, item.payload.Ref, "result", result)...)
+}
+
+// run processes jobs from the main queue until shutdown, then waits for
+// workers of dedicated endpoint queues to finish
+func (hh *hookHandler) run() {
+	defer close(hh.done)
+	hh.serve(hh.queue)
+	hh.mu.Lock()
+	hh.stopped = true
+	hh.mu.Unlock()
+	hh.workers.Wait()
+}
+
+// serve runs worker for q until shutdown. If -worker-recycle is set, worker
+// goroutine is periodically replaced with a fresh one while idle.
+func (hh *hookHandler) serve(q *jobQueue) {
+	for {
+		recycled := make(chan bool)
+		go func() { recycled <- hh.work(q) }()
+		if !<-recycled {
 			return
 		}
-		if withSecret {
-			sig2 := fmt.Sprintf("%x", mac.Sum(nil))
-			if sig != sig2 {
-				log.Printf("signature mismatch, got %q, want %q", sig, sig2)
-				http.Error(w, "signature mismatch",
-					http.StatusPreconditionFailed)
-				return
-			}
+		hh.infof("worker recycled")
+	}
+}
+
+// work runs jobs from q one by one until shutdown and q is drained, it
+// returns true if it stopped while idle for the worker to be recycled
+func (hh *hookHandler) work(q *jobQueue) bool {
+	var recycle <-chan time.Time
+	if hh.recycle > 0 {
+		t := time.NewTimer(hh.recycle)
+		defer t.Stop()
+		recycle = t.C
+	}
+	for hh.base.Err() == nil {
+		if q == hh.queue {
+			hh.unspill()
 		}
-		if payload.Repository.Name != ep.RepoName {
-			log.Printf("repository names mismatch: got %q, want %q",
-				payload.Repository.Name, ep.RepoName)
-			http.Error(w, "repository mismatch",
-				http.StatusPreconditionFailed)
-			return
+		if item, ok := q.pop(); ok {
+			hh.process(item)
+			continue
 		}
 		select {
-		case hh.cmds <- execEnv{payload, ep}:
-		default: // spillover
-			log.Print("buffer spillover")
-			http.Error(w, "spillover", http.StatusServiceUnavailable)
-			return
+		case <-q.notify:
+		case <-recycle:
+			return true
+		case <-hh.drain:
+			if q.len() == 0 {
+				return false
+			}
 		}
 	}
+	return false
 }
 
-// execEnv used to pass both payload and endpoint info via channel
-type execEnv struct {
-	payload  pushPayload
-	endpoint endpoint
+// queueFor returns queue endpoint jobs should be pushed to: either the main
+// one, or dedicated endpoint queue if endpoint sets its own queue size. Worker
+// of dedicated queue is started once queue is created. It returns nil if
+// dedicated queue is needed, but handler is already shut down.
+func (hh *hookHandler) queueFor(ep endpoint) *jobQueue {
+	if ep.QueueSize <= 0 {
+		return hh.queue
+	}
+	hh.mu.Lock()
+	defer hh.mu.Unlock()
+	if q, ok := hh.queues[ep.path]; ok {
+		return q
+	}
+	if hh.stopped {
+		return nil
+	}
+	if hh.queues == nil {
+		hh.queues = make(map[string]*jobQueue)
+	}
+	q := newJobQueue(ep.QueueSize, false)
+	hh.queues[ep.path] = q
+	hh.workers.Add(1)
+	go func() {
+		defer hh.workers.Done()
+		hh.serve(q)
+	}()
+	return q
 }
 
-type pushPayload struct {
-	Ref        string `json:"ref"`
-	Repository struct {
-		Name     string `json:"name"`
-		FullName string `json:"full_name"`
-		HttpUrl  string `json:"html_url"`
-		SshUrl   string `json:"ssh_url"`
-		GitUrl   string `json:"git_url"`
-		CloneUrl string `json:"clone_url"`
-	} `json:"repository"`
+// queued returns number of jobs in all queues, including spilled ones
+func (hh *hookHandler) queued() int {
+	n := hh.queue.len()
+	hh.mu.RLock()
+	defer hh.mu.RUnlock()
+	for _, q := range hh.queues {
+		n += q.len()
+	}
+	if hh.spill != nil {
+		n += hh.spill.len()
+	}
+	return n
 }
 
-// endpoint represents config for one repository, handled by particular url
-type endpoint struct {
-	RepoName string
-	Secret   string
-	Command  string // global command used if no per-ref command found
-	Args     []string
-	Refs     map[string]struct {
-		Command string // per-ref commands
-		Args    []string
+// exitError describes command that ran but failed
+type exitError struct {
+	kind string // one of: timeout, shutdown, signal, exit
+	code int    // process exit code, -1 if it was killed by signal
+	err  error
+}
+
+func (e *exitError) Error() string {
+	switch e.kind {
+	case "timeout":
+		return "command timed out, " + e.err.Error()
+	case "shutdown":
+		return "command killed on shutdown, " + e.err.Error()
 	}
+	return e.err.Error()
 }
 
-// readConfig loads configuration from yaml file
-//
-// Config should be in form map[string]endpoint, where keys are urls used to set
-// up http handlers.
-func readConfig(fileName string) (map[string]endpoint, error) {
-	b, err := ioutil.ReadFile(fileName)
+func (e *exitError) Unwrap() error { return e.err }
+
+// writePayloadFile writes payload to a new temporary file readable by owner
+// only, returning its name
+func writePayloadFile(body []byte) (string, error) {
+	f, err := os.CreateTemp("", "ghwh-payload-*.json")
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	out := make(map[string]endpoint)
-	if err := yaml.Unmarshal(b, out); err != nil {
-		return nil, err
+	if _, err := f.Write(body); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
 	}
-	return out, nil
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// errNotFound is wrapped by errors of commands that could not be started as
+// they don't exist
+var errNotFound = errors.New("command not found")
+
+// startError wraps error of starting command, so that missing command stands
+// out from other failures: usually it means command was moved or endpoint is
+// misconfigured
+func startError(name string, err error) error {
+	switch {
+	case errors.Is(err, exec.ErrNotFound):
+		return fmt.Errorf("%w: %q is not found in PATH", errNotFound, name)
+	case errors.Is(err, fs.ErrNotExist):
+		return fmt.Errorf("%w: %q does not exist", errNotFound, name)
+	}
+	return err
+}
+
+// classifyExit wraps error returned by exec.Cmd.Wait into *exitError,
+// telling timeouts apart from signal kills and non-zero exits
+func classifyExit(ctx context.Context, err error) error {
+	var ee *exec.ExitError
+	if !errors.As(err, &ee) {
+		return err
+	}
+	out := &exitError{kind: "exit", code: ee.ExitCode(), err: err}
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		out.kind = "timeout"
+	case ctx.Err() != nil:
+		out.kind = "shutdown"
+	case out.code == -1:
+		out.kind = "signal"
+	}
+	return out
+}
+
+// shutdown makes run return once the queue is empty and waits for it. If
+// timeout is positive and queue is not drained in time, running command is
+// killed and jobs left in the queue are dropped.
+func (hh *hookHandler) shutdown(timeout time.Duration) {
+	ctx := hh.base
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	hh.flushBatches(ctx)
+	close(hh.drain)
+	var expired <-chan struct{}
+	if timeout > 0 {
+		expired = ctx.Done()
+	}
+	select {
+	case <-hh.done:
+		return
+	case <-expired:
+	}
+	log.Printf("queue not drained in %v, killing running command", timeout)
+	hh.kill()
+	<-hh.done
+	hh.mu.RLock()
+	queues := []*jobQueue{hh.queue}
+	for _, q := range hh.queues {
+		queues = append(queues, q)
+	}
+	hh.mu.RUnlock()
+	for _, q := range queues {
+		for {
+			item, ok := q.pop()
+			if !ok {
+				break
+			}
+			if hh.journal != nil {
+				log.Printf("%squeued job is kept in journal to run on the next start",
+					hh.jobPrefix(item))
+				continue
+			}
+			log.Printf("%sdropping queued job", hh.jobPrefix(item))
+		}
+	}
+}
+
+// context returns context limited by the configured command timeout
+func (hh *hookHandler) context() (context.Context, context.CancelFunc) {
+	if hh.timeout > 0 {
+		return context.WithTimeout(hh.base, hh.timeout)
+	}
+	return context.WithCancel(hh.base)
+}
+
+// runnerFor returns command prefix for endpoint commands: its own
+// RunnerPrefix, or -runner if endpoint doesn't set one
+func (hh *hookHandler) runnerFor(ep endpoint) []string {
+	if ep.RunnerPrefix != nil {
+		return ep.RunnerPrefix
+	}
+	return hh.runner
+}
+
+// withPrefix returns name and arguments to run command with prefix prepended
+func withPrefix(prefix []string, name string, args []string) (string, []string) {
+	if len(prefix) == 0 {
+		return name, args
+	}
+	return prefix[0], append(append(prefix[1:len(prefix):len(prefix)], name), args...)
+}
+
+// dispatch runs endpoint dispatcher program to find out which command to run.
+// Dispatcher is called with event type, ref and repository name as arguments
+// and is expected to print JSON object with "command" and "args" keys. Empty
+// command name means nothing should be run.
+func (hh *hookHandler) dispatch(item execEnv) (string, []string, error) {
+	ctx, cancel := hh.context()
+	defer cancel()
+	name, args := withPrefix(hh.runnerFor(item.endpoint), item.endpoint.Dispatcher,
+		[]string{item.event, item.payload.Ref, item.payload.Repository.Name})
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = item.environ()
+	if hh.verbose {
+		cmd.Stderr = os.Stderr
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return "", nil, fmt.Errorf("dispatcher run: %w", startError(name, err))
+	}
+	if len(bytes.TrimSpace(out)) == 0 {
+		return "", nil, nil
+	}
+	var res struct {
+		Command string   `json:"command"`
+		Args    []string `json:"args"`
+	}
+	if err := json.Unmarshal(out, &res); err != nil {
+		return "", nil, fmt.Errorf("dispatcher output: %v", err)
+	}
+	return res.Command, res.Args, nil
+}
+
+// endpointHandler constructs http.HandlerFunc for particular endpoint
+func (hh *hookHandler) endpointHandler(ep endpoint) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		received := time.Now()
+		if ep.path == defaultEndpoint {
+			log.Printf("request to %q is handled by default endpoint", r.URL.Path)
+			w.Header().Set("X-GHWH-Endpoint", "default")
+		}
+		reqID := requestID(r)
+		w.Header().Set("X-Request-Id", reqID)
+		fail := func(msg string, code int) { ep.httpError(w, reqID, msg, code) }
+		if r.Method != "POST" {
+			fail("unsupported method",
+				http.StatusMethodNotAllowed)
+			return
+		}
+		// GitHub always sets Content-Length, so strict mode rejects
+		// chunked requests and the ones with unknown length
+		if hh.needLen && (r.ContentLength < 0 || len(r.TransferEncoding) > 0 ||
+			r.Header.Get("Content-Length") == "") {
+			fail("content length required", http.StatusLengthRequired)
+			return
+		}
+		// reject oversized deliveries before reading anything if their
+		// size is known, otherwise limit how much is read
+		if hh.maxBody > 0 {
+			if r.ContentLength > hh.maxBody {
+				log.Printf("%s: id: %q, request body of %d bytes exceeds %d bytes limit",
+					ep.path, reqID, r.ContentLength, hh.maxBody)
+				fail("payload too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, hh.maxBody)
+		}
+		if ep.RequireClientCert {
+			if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+				log.Printf("%s: id: %q, request without verified client certificate", ep.path, reqID)
+				fail("client certificate required", http.StatusForbidden)
+				return
+			}
+			hh.infof("%s: id: %q, client certificate subject: %s", ep.path, reqID,
+				r.TLS.PeerCertificates[0].Subject)
+		}
+		event := r.Header.Get(ep.eventHeader())
+		switch {
+		case event == "ping":
+			return // accept with code 200
+		case ep.AppMode && !ep.accepts(event):
+			// app receives all events it's subscribed to, no need
+			// to report failure for the ones not configured here
+			hh.infof("%s: ignoring %q event", ep.path, event)
+			return
+		case !ep.accepts(event):
+			fail("unsupported event type",
+				http.StatusBadRequest)
+			return
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			if hh.sigDiag != nil {
+				log.Printf("%s: id: %q, content type is %q instead of application/json: "+
+					"either hook is configured with form content type, or proxy rewrote it",
+					ep.path, reqID, ct)
+			}
+			fail("unsupported content type",
+				http.StatusUnsupportedMediaType)
+			return
+		}
+		if err := ep.checkTarget(r.Header); err != nil {
+			log.Printf("%s: %v", ep.path, err)
+			fail("hook target mismatch",
+				http.StatusPreconditionFailed)
+			return
+		}
+		// GitHub Enterprise Server deliveries are the same as github.com
+		// ones, apart from these headers and the enterprise object
+		ghes := r.Header.Get("X-Github-Enterprise-Version")
+		if len(ghes) > 0 {
+			hh.infof("%s: id: %q, delivery from GitHub Enterprise Server %s (%s)",
+				ep.path, reqID, ghes, r.Header.Get("X-Github-Enterprise-Host"))
+		}
+		// with client certificates required, signature is optional
+		// unless endpoint has a secret
+		algo, sig := "sha256", ""
+		if !ep.RequireClientCert || len(ep.Secret) > 0 {
+			var err error
+			if algo, sig, err = ep.requestSignature(r.Header); err != nil {
+				fail(err.Error(), http.StatusForbidden)
+				return
+			}
+		}
+		ctx := r.Context()
+		if hh.readBody > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, hh.readBody)
+			defer cancel()
+			deadline, _ := ctx.Deadline()
+			if err := http.NewResponseController(w).SetReadDeadline(deadline); err != nil {
+				log.Printf("setting body read deadline: %v", err)
+			}
+		}
+		raw, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Print(err)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				fail("body read timeout", http.StatusRequestTimeout)
+				return
+			}
+			var me *http.MaxBytesError
+			if errors.As(err, &me) {
+				fail("payload too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			fail("body read error", http.StatusBadRequest)
+			return
+		}
+		body := raw
+		switch r.Header.Get("Content-Encoding") {
+		case "", "identity":
+		case "gzip":
+			if body, err = gunzip(raw); err != nil {
+				log.Print(err)
+				fail("malformed gzip body", http.StatusBadRequest)
+				return
+			}
+		default:
+			fail("unsupported content encoding",
+				http.StatusUnsupportedMediaType)
+			return
+		}
+		payload, err := parsers[event](body)
+		switch {
+		case errors.Is(err, errBadPayload):
+			fail("malformed "+event+" payload",
+				http.StatusBadRequest)
+			return
+		case err != nil:
+			log.Print(err)
+			if hh.sigDiag != nil {
+				for _, s := range bodyHints(r.Header, raw) {
+					log.Printf("%s: id: %q, payload diagnostics: %s", ep.path, reqID, s)
+				}
+			}
+			fail("malformed json",
+				http.StatusInternalServerError)
+			return
+		}
+		// per-ref secret takes precedence over endpoint one
+		secret := ep.Secret
+		if c, ok := ep.refRule(payload.Ref); ok && len(c.Secret) > 0 {
+			secret = c.Secret
+		}
+		// senders differ on whether compressed body is signed as sent or
+		// before compression, so accept either
+		if len(secret) > 0 && !validSignature(algo, []byte(secret), sig, raw, body) {
+			log.Printf("id: %q, signature mismatch, got %s=%q, want %q", reqID,
+				algo, sig, hmacHex(algo, []byte(secret), raw))
+			if hh.sigDiag != nil {
+				hh.sigDiag.diagnoseSignature(ep.path, reqID, r.Header, raw)
+			}
+			fail("signature mismatch",
+				http.StatusPreconditionFailed)
+			return
+		}
+		if ctx.Err() != nil {
+			log.Printf("%s: request body not read and verified in %v",
+				ep.path, hh.readBody)
+			fail("body read timeout", http.StatusRequestTimeout)
+			return
+		}
+		if hh.logKeys { // only for verified payloads
+			logUnknownKeys(event, body)
+		}
+		if len(ep.ArchiveDir) > 0 {
+			delivery, header := r.Header.Get("X-Github-Delivery"), r.Header.Clone()
+			go func() {
+				if err := archivePayload(ep.ArchiveDir, delivery, header, body); err != nil {
+					log.Printf("payload archive: %v", err)
+				}
+			}()
+		}
+		if ep.schema != nil {
+			v, err := jsonschema.UnmarshalJSON(bytes.NewReader(body))
+			if err == nil {
+				err = ep.schema.Validate(v)
+			}
+			if err != nil {
+				log.Printf("%s: id: %q, payload does not match schema: %v", ep.path, reqID, err)
+				fail("payload does not match schema",
+					http.StatusUnprocessableEntity)
+				return
+			}
+		}
+		if hh.refCheck != "off" {
+			if reason := checkRef(payload.Ref); len(reason) > 0 {
+				log.Printf("%s: id: %q, suspicious ref %q: %s", ep.path, reqID, payload.Ref, reason)
+				if hh.refCheck == "reject" {
+					fail("suspicious ref", http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		ep := ep // may be narrowed down to particular repository below
+		switch {
+		case ep.AppMode:
+			sub, ok := ep.Repos[payload.Repository.FullName]
+			if !ok && ep.FailOnNoMatch {
+				log.Printf("%s: no config for repository %q",
+					ep.path, payload.Repository.FullName)
+				fail("no matching command",
+					http.StatusUnprocessableEntity)
+				return
+			}
+			if !ok {
+				hh.infof("%s: no config for repository %q, skipping",
+					ep.path, payload.Repository.FullName)
+				return
+			}
+			ep = ep.forRepo(sub)
+		case ep.Org != "":
+			if payload.Organization.Login != ep.Org {
+				log.Printf("organization mismatch: got %q, want %q",
+					payload.Organization.Login, ep.Org)
+				fail("organization mismatch",
+					http.StatusPreconditionFailed)
+				return
+			}
+		case ep.RepoID != 0:
+			if payload.Repository.ID != ep.RepoID {
+				log.Printf("repository ids mismatch: got %d (%q), want %d",
+					payload.Repository.ID, payload.Repository.Name, ep.RepoID)
+				fail("repository mismatch",
+					http.StatusPreconditionFailed)
+				return
+			}
+		case len(ep.RepoNames) > 0:
+			if !slices.Contains(ep.RepoNames, payload.Repository.Name) {
+				log.Printf("repository names mismatch: got %q, want one of %q",
+					payload.Repository.Name, ep.RepoNames)
+				fail("repository mismatch",
+					http.StatusPreconditionFailed)
+				return
+			}
+		case ep.RepoName != "*" && payload.Repository.Name != ep.RepoName:
+			log.Printf("repository names mismatch: got %q, want %q",
+				payload.Repository.Name, ep.RepoName)
+			fail("repository mismatch",
+				http.StatusPreconditionFailed)
+			return
+		}
+		if hc := payload.HeadCommit; ep.MaxAge > 0 && hc != nil &&
+			time.Since(hc.Timestamp) > ep.MaxAge {
+			log.Printf("%s: head commit %s is older than %v (%v), rejecting",
+				ep.path, hc.ID, ep.MaxAge, hc.Timestamp)
+			fail("head commit is too old",
+				http.StatusUnprocessableEntity)
+			return
+		}
+		if ep.FailOnNoMatch && !ep.hasCommand(payload.Ref) {
+			log.Printf("%s: no matching command for ref %q",
+				ep.path, payload.Ref)
+			fail("no matching command",
+				http.StatusUnprocessableEntity)
+			return
+		}
+		var headers map[string]string
+		for _, name := range ep.Headers {
+			if v := r.Header.Get(name); len(v) > 0 {
+				if headers == nil {
+					headers = make(map[string]string)
+				}
+				headers[name] = v
+			}
+		}
+		job := execEnv{
+			event:     event,
+			payload:   payload,
+			endpoint:  ep,
+			headers:   headers,
+			requestID: reqID,
+			ghes:      ghes,
+		}
+		if ep.PayloadFile {
+			job.body = body
+		}
+		if ep.RejectBusy && !hh.busy.acquire(busyKey(job)) {
+			log.Printf("%s: id: %q, job for repository %q is already queued or running, rejecting",
+				ep.path, reqID, payload.Repository.Name)
+			fail("previous job is still in progress", http.StatusConflict)
+			return
+		}
+		var q *jobQueue
+		if ep.BatchInterval > 0 {
+			hh.addBatch(job)
+		} else {
+			if err := hh.journal.add(&job); err != nil {
+				hh.busy.release(busyKey(job))
+				log.Printf("%s: id: %q, journal: %v", ep.path, reqID, err)
+				fail("journal write error", http.StatusInternalServerError)
+				return
+			}
+			q = hh.queueFor(ep)
+			ctx := r.Context()
+			if hh.block {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithDeadline(ctx, received.Add(serverWriteTimeout-responseMargin))
+				defer cancel()
+			}
+			switch err := hh.enqueue(ctx, q, job); {
+			case err == errRefLimit:
+				hh.busy.release(busyKey(job))
+				log.Printf("%s: id: %q, limit of %d queued jobs for ref %q reached, rejecting",
+					ep.path, reqID, ep.RefQueueLimit, payload.Ref)
+				fail("too many queued jobs for ref", http.StatusServiceUnavailable)
+				return
+			case err == errQueueFull:
+				hh.busy.release(busyKey(job))
+				log.Printf("id: %q, buffer spillover", reqID)
+				fail("spillover", http.StatusServiceUnavailable)
+				return
+			case err != nil:
+				hh.busy.release(busyKey(job))
+				log.Printf("id: %q, buffer spillover: %v", reqID, err)
+				fail("spillover", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		hh.stats.update(ep.path, func(st *endpointStats) { st.Accepted++ })
+		hh.metrics.inc("ghwh_deliveries_total",
+			metricLabels(ep, event, payload.Ref)...)
+		if len(ep.Forward) > 0 {
+			header := r.Header.Clone()
+			for _, u := range ep.Forward {
+				go func(u string) {
+					if err := forward(u, header, ep.OutboundSecret, raw); err != nil {
+						log.Printf("%s: forward to %s: %v", ep.path, redactedURL(u), err)
+					}
+				}(u)
+			}
+		}
+		// approximate, as worker may already have picked up some jobs
+		if q != nil {
+			w.Header().Set("X-GHWH-Queue-Position", strconv.Itoa(q.len()))
+		}
+		if len(ep.SuccessBody) > 0 {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		}
+		if ep.SuccessStatus != 0 {
+			w.WriteHeader(ep.SuccessStatus)
+		}
+		if len(ep.SuccessBody) > 0 {
+			io.WriteString(w, ep.SuccessBody)
+		}
+	}
+}
+
+// hashes maps supported signature algorithms to hash constructors
+var hashes = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// signatureHeaders lists supported signature headers, the strongest first
+var signatureHeaders = [...]struct{ algo, header string }{
+	{"sha256", "X-Hub-Signature-256"},
+	{"sha1", "X-Hub-Signature"},
+}
+
+// requestSignature returns hex-encoded request signature and the name of its
+// algorithm, picking the strongest algorithm endpoint allows
+func (ep endpoint) requestSignature(h http.Header) (algo, sig string, err error) {
+	if len(ep.SignatureHeader) > 0 {
+		algo = "sha256"
+		if len(ep.Algorithms) > 0 {
+			algo = ep.Algorithms[0]
+		}
+		prefix := algo + "="
+		if ep.SignaturePrefix != nil {
+			prefix = *ep.SignaturePrefix
+		}
+		v := h.Get(ep.SignatureHeader)
+		if !strings.HasPrefix(v, prefix) || len(v) == len(prefix) {
+			return "", "", errors.New("malformed signature")
+		}
+		return algo, v[len(prefix):], nil
+	}
+	var seen bool
+	for _, s := range signatureHeaders {
+		v := h.Get(s.header)
+		if len(v) == 0 {
+			continue
+		}
+		seen = true
+		if !ep.allowsAlgorithm(s.algo) {
+			continue
+		}
+		if !strings.HasPrefix(v, s.algo+"=") || len(v) == len(s.algo)+1 {
+			return "", "", errors.New("malformed signature")
+		}
+		return s.algo, v[len(s.algo)+1:], nil
+	}
+	if seen {
+		return "", "", errors.New("signature algorithm not allowed")
+	}
+	return "", "", errors.New("malformed signature")
+}
+
+// eventHeader returns name of request header carrying event type
+func (ep endpoint) eventHeader() string {
+	if len(ep.EventHeader) > 0 {
+		return ep.EventHeader
+	}
+	return "X-Github-Event"
+}
+
+// errorData holds fields available to endpoint error body template
+type errorData struct {
+	Status     int    // response status code, i.e. 412
+	StatusText string // status text, i.e. "Precondition Failed"
+	Message    string // short description, i.e. "signature mismatch"
+	RequestID  string
+}
+
+// httpError replies to rejected delivery with error message, rendered with
+// endpoint error body template if it has one
+func (ep endpoint) httpError(w http.ResponseWriter, reqID, msg string, code int) {
+	if ep.errorBody != nil {
+		var buf strings.Builder
+		err := ep.errorBody.Execute(&buf, errorData{
+			Status:     code,
+			StatusText: http.StatusText(code),
+			Message:    msg,
+			RequestID:  reqID,
+		})
+		if err == nil {
+			msg = buf.String()
+		} else {
+			log.Printf("%s: error body template: %v", ep.path, err)
+		}
+	}
+	http.Error(w, msg, code)
+}
+
+// validSignature reports whether hex-encoded sig is HMAC of any of the blobs
+// signed with secret using given algorithm
+func validSignature(algo string, secret []byte, sig string, blobs ...[]byte) bool {
+	// decoding handles both lower and upper case hex
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	for _, b := range blobs {
+		mac := hmac.New(hashes[algo], secret)
+		mac.Write(b)
+		if hmac.Equal(got, mac.Sum(nil)) {
+			return true
+		}
+	}
+	return false
+}
+
+// hmacHex returns hex-encoded HMAC of b signed with secret using given
+// algorithm
+func hmacHex(algo string, secret, b []byte) string {
+	mac := hmac.New(hashes[algo], secret)
+	mac.Write(b)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// maxPayloadSize matches payload size cap GitHub applies to webhook deliveries
+const maxPayloadSize = 25 << 20
+
+// gunzip decompresses gzipped body, refusing to decompress more than
+// maxPayloadSize bytes
+func gunzip(b []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	out, err := ioutil.ReadAll(io.LimitReader(zr, maxPayloadSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > maxPayloadSize {
+		return nil, fmt.Errorf("decompressed payload exceeds %d bytes", maxPayloadSize)
+	}
+	return out, nil
+}
+
+// archivePayload saves payload along with request headers as a new
+// timestamped file inside dir
+func archivePayload(dir, delivery string, header http.Header, body []byte) error {
+	now := time.Now().UTC()
+	name := filepath.Join(dir, now.Format("20060102T150405.000000000Z")+"-"+safeName(delivery)+".json")
+	b, err := json.Marshal(struct {
+		Received time.Time       `json:"received"`
+		Headers  http.Header     `json:"headers"`
+		Payload  json.RawMessage `json:"payload"`
+	}{now, header, body})
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// safeName returns s with all but ASCII letters, digits and dashes removed,
+// for use in file names
+func safeName(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-':
+			return r
+		}
+		return -1
+	}, s)
+	if len(s) == 0 {
+		return "unknown"
+	}
+	return s
+}
+
+// execEnv used to pass both payload and endpoint info via channel; endpoint
+// is a copy of its config at the time of delivery
+type execEnv struct {
+	event    string
+	payload  hookPayload
+	endpoint endpoint
+	headers  map[string]string // request headers exported to command
+
+	requestID string // X-Request-Id of delivery, passed to command and logs
+	ghes      string // GitHub Enterprise Server version, empty for github.com
+
+	batchCount int      // number of deliveries batched into this job
+	batchRefs  []string // unique refs of batched deliveries
+
+	journal string // journal file of the job, see jobJournal
+	body    []byte // decoded payload, only kept if endpoint sets PayloadFile
+}
+
+// environ returns environment for commands run for this job
+func (item execEnv) environ() []string {
+	var env []string
+	if !item.endpoint.CleanEnv {
+		env = os.Environ()
+	}
+	env = append(env, item.endpoint.Env...)
+	env = append(env,
+		"GHWH_EVENT="+item.event,
+		"GHWH_REPO="+item.payload.Repository.Name,
+		"GHWH_REPO_FULL_NAME="+item.payload.Repository.FullName,
+		"GHWH_REF="+item.payload.Ref,
+		"GHWH_CLONE_URL="+item.payload.Repository.CloneUrl,
+		"GHWH_SSH_URL="+item.payload.Repository.SshUrl,
+		"GHWH_REQUEST_ID="+item.requestID,
+	)
+	if len(item.ghes) > 0 {
+		env = append(env, "GHWH_GHES_VERSION="+item.ghes)
+	}
+	if e := item.payload.Enterprise; e != nil {
+		env = append(env, "GHWH_ENTERPRISE="+e.Slug)
+	}
+	if item.batchCount > 0 {
+		env = append(env,
+			"GHWH_BATCH_COUNT="+strconv.Itoa(item.batchCount),
+			"GHWH_BATCH_REFS="+strings.Join(item.batchRefs, "\n"),
+		)
+	}
+	if len(item.payload.Action) > 0 {
+		env = append(env, "GHWH_ACTION="+item.payload.Action)
+	}
+	if item.event == "push" {
+		// payload lists up to maxPushCommits commits, so larger pushes
+		// are counted as that many
+		env = append(env, "GHWH_COMMIT_COUNT="+strconv.Itoa(min(len(item.payload.Commits), maxPushCommits)))
+		if item.endpoint.ChangedFiles {
+			files, truncated := changedFiles(item.payload)
+			env = append(env, "GHWH_CHANGED_FILES="+strings.Join(files, "\n"))
+			if truncated {
+				env = append(env, "GHWH_CHANGED_FILES_TRUNCATED=true")
+			}
+		}
+	}
+	if len(item.payload.RefType) > 0 {
+		_, name := refKind(item.payload.Ref)
+		env = append(env,
+			"GHWH_REF_TYPE="+item.payload.RefType,
+			"GHWH_REF_NAME="+name,
+		)
+	}
+	if rel := item.payload.Release; rel != nil {
+		urls := make([]string, 0, len(rel.Assets))
+		for _, a := range rel.Assets {
+			urls = append(urls, a.DownloadUrl)
+		}
+		env = append(env,
+			"GHWH_RELEASE_TAG="+rel.TagName,
+			"GHWH_RELEASE_URL="+rel.HtmlUrl,
+			"GHWH_RELEASE_ASSETS="+strings.Join(urls, "\n"),
+		)
+	}
+	if pr := item.payload.PullRequest; pr != nil {
+		env = append(env,
+			"GHWH_PR_NUMBER="+strconv.Itoa(pr.Number),
+			"GHWH_PR_URL="+pr.HtmlUrl,
+			"GHWH_PR_MERGED="+strconv.FormatBool(pr.Merged),
+			"GHWH_PR_MERGE_SHA="+pr.MergeCommitSha,
+			"GHWH_PR_BASE="+pr.Base.Ref,
+			"GHWH_PR_HEAD="+pr.Head.Ref,
+		)
+	}
+	for k, v := range item.headers {
+		env = append(env, "GHWH_HEADER_"+envName(k)+"="+v)
+	}
+	return env
+}
+
+// maxPushCommits is the number of commits GitHub lists in push webhook
+// payload at most
+const maxPushCommits = 2048
+
+// maxChangedFilesSize limits size of GHWH_CHANGED_FILES value, keeping it well
+// below per-variable limit of the OS
+const maxChangedFilesSize = 64 << 10
+
+// changedFiles returns unique paths added, modified or removed by commits of
+// push, in order they were first seen. It reports whether list may be
+// incomplete: either because GitHub didn't list all commits of a large push,
+// or because list exceeded maxChangedFilesSize.
+func changedFiles(p hookPayload) (files []string, truncated bool) {
+	seen := make(map[string]struct{})
+	var size int
+	for _, c := range p.Commits {
+		for _, list := range [][]string{c.Added, c.Modified, c.Removed} {
+			for _, name := range list {
+				if _, ok := seen[name]; ok {
+					continue
+				}
+				if size += len(name) + 1; size > maxChangedFilesSize {
+					return files, true
+				}
+				seen[name] = struct{}{}
+				files = append(files, name)
+			}
+		}
+	}
+	return files, len(p.Commits) >= maxPushCommits
+}
+
+// maxRequestIDSize limits size of X-Request-Id header value accepted from
+// clients
+const maxRequestIDSize = 128
+
+// requestID returns X-Request-Id header value of request if it is present and
+// looks sane, otherwise it generates a new random id
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); len(id) > 0 && len(id) <= maxRequestIDSize &&
+		strings.IndexFunc(id, func(r rune) bool { return r <= ' ' || r > '~' }) == -1 {
+		return id
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// envName converts header name to a form suitable as environment variable
+// name, i.e. X-Github-Event becomes X_GITHUB_EVENT
+func envName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		}
+		return '_'
+	}, s)
+}
+
+// hookPayload holds fields of interest of all supported event payloads
+type hookPayload struct {
+	Ref        string `json:"ref"`
+	After      string `json:"after"`    // commit ref points to after push
+	Action     string `json:"action"`   // set for release and pull_request events
+	RefType    string `json:"ref_type"` // set for create and delete events
+	Repository struct {
+		ID       int64  `json:"id"`
+		Name     string `json:"name"`
+		FullName string `json:"full_name"`
+		HttpUrl  string `json:"html_url"`
+		SshUrl   string `json:"ssh_url"`
+		GitUrl   string `json:"git_url"`
+		CloneUrl string `json:"clone_url"`
+	} `json:"repository"`
+	Organization struct {
+		Login string `json:"login"`
+	} `json:"organization"`
+	// set for repositories owned by an enterprise account, both on GitHub
+	// Enterprise Server and Cloud
+	Enterprise *struct {
+		Slug string `json:"slug"`
+		Name string `json:"name"`
+	} `json:"enterprise"`
+	Commits []struct {
+		Added    []string `json:"added"`
+		Removed  []string `json:"removed"`
+		Modified []string `json:"modified"`
+	} `json:"commits"` // set for push events
+	HeadCommit *struct {
+		ID        string    `json:"id"`
+		Timestamp time.Time `json:"timestamp"`
+	} `json:"head_commit"`
+	Release *struct {
+		TagName string `json:"tag_name"`
+		HtmlUrl string `json:"html_url"`
+		Assets  []struct {
+			Name        string `json:"name"`
+			DownloadUrl string `json:"browser_download_url"`
+		} `json:"assets"`
+	} `json:"release"`
+	PullRequest *struct {
+		Number         int    `json:"number"`
+		HtmlUrl        string `json:"html_url"`
+		Merged         bool   `json:"merged"`
+		MergeCommitSha string `json:"merge_commit_sha"`
+		Base           struct {
+			Ref string `json:"ref"`
+		} `json:"base"`
+		Head struct {
+			Ref string `json:"ref"`
+		} `json:"head"`
+	} `json:"pull_request"`
+}
+
+// knownKeys holds top-level json keys of hookPayload
+var knownKeys = func() map[string]bool {
+	out := make(map[string]bool)
+	t := reflect.TypeOf(hookPayload{})
+	for i := 0; i < t.NumField(); i++ {
+		if name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]; len(name) > 0 {
+			out[name] = true
+		}
+	}
+	return out
+}()
+
+// logUnknownKeys logs top-level payload keys ghwh doesn't use, which helps to
+// spot payload structure changes
+func logUnknownKeys(event string, body []byte) {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(body, &m); err != nil {
+		return
+	}
+	var unknown []string
+	for k := range m {
+		if !knownKeys[k] {
+			unknown = append(unknown, k)
+		}
+	}
+	if len(unknown) == 0 {
+		return
+	}
+	sort.Strings(unknown)
+	log.Printf("%s event payload unknown top-level keys: %s", event,
+		strings.Join(unknown, ", "))
+}
+
+// endpoint represents config for one repository, handled by particular url
+type endpoint struct {
+	RepoName  string   // "*" matches any repository
+	RepoNames []string // alternative to RepoName, matches any of listed
+	// RepoID, if set, is matched against repository id instead of its name,
+	// which is stable across repository renames
+	RepoID  int64
+	Org     string // if set, match any repository of this organization
+	Secret  string
+	Command string // global command used if no per-ref command found
+	Args    []string
+	Exec    []string // alternative to Command and Args, command goes first
+	// CommandRefs, if set, limits global command to refs matching any of
+	// these path.Match patterns; other refs without per-ref command are
+	// skipped
+	CommandRefs []string
+	// SecretCommand, if set, is run on config load to get secret from its
+	// output, i.e. from secret manager, so that it's not stored in config
+	SecretCommand []string `yaml:"secret_command"`
+	// SecretRotatedAt is when secret was last changed, for -warn-secret-age
+	SecretRotatedAt *time.Time `yaml:"secret_rotated_at"`
+	// Dispatcher, if set, is called to find out which command to run,
+	// overriding both per-ref and global commands
+	Dispatcher string
+	// When, if set, is an expression that must be true for the job to run
+	// any command
+	When string
+	// Routes are checked in order before per-ref and global commands, the
+	// first one with expression true for the job selects command to run
+	Routes     []route
+	ArchiveDir string   // directory to save verified payloads to
+	Events     []string // accepted event types, only push if empty
+	Headers    []string // request headers to pass to command environment
+	// FailOnNoMatch makes deliveries no command matches rejected with 422
+	// instead of quietly accepted
+	FailOnNoMatch bool
+	// MergedOnly makes pull_request events only run commands when pull
+	// request is closed by merge
+	MergedOnly bool
+	// RequireCommits makes push events with no commits, like ref deletions
+	// or pushes of already known commits, skipped
+	RequireCommits bool
+	// ChangedFiles makes paths added, modified or removed by pushed commits
+	// passed to command, see changedFiles
+	ChangedFiles bool
+	// MaxAge, if positive, makes deliveries with head commit older than that
+	// rejected, guarding against replay of old deliveries
+	MaxAge time.Duration
+	// TempDir makes each command run inside a fresh temporary directory,
+	// removed once command exits
+	TempDir bool
+	// PayloadFile makes decoded payload written to a temporary file for
+	// each command run, its path passed to command as GHWH_PAYLOAD_FILE;
+	// file is removed once command exits
+	PayloadFile bool
+	// IOWeight, if positive, is how much of -max-io-concurrency limit
+	// endpoint command takes while running, i.e. 2 for a full clone and 1
+	// for a fetch
+	IOWeight int
+	// RefQueueLimit, if positive, caps number of queued jobs per ref, so
+	// that rapidly updated branch doesn't fill the whole queue; once it's
+	// reached, RefQueuePolicy tells whether new job is rejected ("reject",
+	// the default) or the oldest queued one of the ref is dropped
+	// ("dropoldest")
+	RefQueueLimit  int
+	RefQueuePolicy string
+	// RunnerPrefix is prepended to every endpoint command, i.e. to run it
+	// via sudo or docker exec; overrides -runner flag, empty list disables
+	// it for endpoint
+	RunnerPrefix []string
+	// Delay is the time to wait before running command, i.e. to let
+	// downstream system catch up with push; it counts towards -timeout
+	Delay time.Duration
+	// QueueSize, if set, gives endpoint its own queue of that size with a
+	// dedicated worker, so that endpoint jobs run concurrently with others
+	// and its backlog doesn't fill the main queue
+	QueueSize int
+	// BatchInterval, if set, makes deliveries accumulate for that long
+	// before one job is queued for the latest of them, with number of
+	// deliveries and their refs passed to command
+	BatchInterval time.Duration
+	// LockFile, if set, is locked for the time command runs, holding ghwh
+	// pid, so that commands of several endpoints or ghwh instances sharing
+	// it don't run concurrently. Lock is waited for up to LockTimeout
+	// (counted towards -timeout, no other limit if 0); it's released if its
+	// process is gone and, with LockStale set, broken once it's older than
+	// that.
+	LockFile    string
+	LockTimeout time.Duration
+	LockStale   time.Duration
+	// PTY makes command run attached to a pseudo-terminal, for tools
+	// behaving differently or refusing to run otherwise
+	PTY bool
+	// RejectBusy makes deliveries rejected with 409 status while previous
+	// job for the same repository is queued or running
+	RejectBusy bool
+	// Env lists extra KEY=value variables set for commands; with CleanEnv
+	// commands don't inherit ghwh environment, getting only these and
+	// GHWH_* variables
+	Env      []string
+	CleanEnv bool
+	// SuccessStatus is http status code for accepted deliveries: 200
+	// (default), 202 or 204
+	SuccessStatus int
+	SuccessBody   string // plain text body of accepted delivery response
+	// Algorithms restricts accepted signature algorithms, both sha256 and
+	// sha1 are accepted if empty
+	Algorithms []string
+	// SignatureHeader and EventHeader override GitHub header names for
+	// other webhook providers; signature in custom header is expected as
+	// hex-encoded HMAC prefixed with SignaturePrefix ("sha256=" by default)
+	// and made with the algorithm from Algorithms (sha256 if empty)
+	SignatureHeader string
+	SignaturePrefix *string
+	EventHeader     string
+	// Enabled set to false disables endpoint without removing it from
+	// config; its requests are rejected with DisabledStatus, either 503
+	// (default) or 404
+	Enabled        *bool
+	DisabledStatus int
+	// RequireClientCert makes endpoint only accept requests with TLS client
+	// certificate verified against -client-ca
+	RequireClientCert bool
+	// Schema is a path to JSON schema payloads are validated against
+	Schema string
+	schema *jsonschema.Schema
+	// ErrorBody, if set, is a text/template of response body for rejected
+	// deliveries, which GitHub shows in its delivery log; see errorData for
+	// fields available
+	ErrorBody string
+	errorBody *template.Template
+	when      *vm.Program
+	// Forward lists urls verified payloads are POSTed to, along with
+	// original headers
+	Forward []string
+	// OutboundSecret is used to sign requests ghwh makes on endpoint behalf
+	OutboundSecret string
+	// Callback is url result of each command run is POSTed to as JSON
+	Callback string
+	Limits   *limits // command niceness and resource limits
+	// CallbackOutput, if set, is the number of last lines of command output
+	// callback result of failed run includes
+	CallbackOutput int
+	// MetricsByRef adds ref label to endpoint metrics; off by default to
+	// keep metrics cardinality bounded for repositories with many branches
+	MetricsByRef bool
+	// SkipDeployed makes command not run for push of a commit that was the
+	// last one successfully deployed for the same ref, i.e. on manual
+	// redelivery; DeployedFile, if set, persists deployed commits across
+	// restarts
+	SkipDeployed bool
+	DeployedFile string
+	// MarkerFile, if set, is rewritten after each successful command run
+	// with JSON describing what was deployed, see deployMarker
+	MarkerFile string
+	// LogFile is a file command output is appended to, instead of being
+	// logged with -verbose; output of a single run is truncated after
+	// MaxOutput bytes (defaultMaxOutput if not set)
+	LogFile   string
+	MaxOutput int64
+	// expected X-GitHub-Hook-Installation-Target-Type and -ID headers,
+	// i.e. "repository" or "integration" and numeric id; any if empty
+	TargetType string
+	TargetID   string
+
+	AllowedSchedule *schedule // if set, only run commands inside these windows
+	Refs            map[string]refConfig
+	// OnBranch and OnTag are used for any branch or tag respectively, if
+	// no rule from Refs matches
+	OnBranch *refConfig `yaml:"on_branch"`
+	OnTag    *refConfig `yaml:"on_tag"`
+
+	// AppMode makes endpoint handle GitHub App webhook: deliveries for all
+	// repositories are verified against the app-wide secret and dispatched
+	// to commands configured for the delivery repository in Repos, keyed by
+	// repository full name
+	AppMode bool
+	Repos   map[string]endpoint
+
+	path string // url path endpoint is registered at
+}
+
+// redactedConfig returns copy of config with secrets masked
+func redactedConfig(cfg map[string]endpoint) map[string]endpoint {
+	out := make(map[string]endpoint, len(cfg))
+	for k, ep := range cfg {
+		out[k] = ep.redacted()
+	}
+	return out
+}
+
+// redacted returns copy of endpoint with secrets masked
+func (ep endpoint) redacted() endpoint {
+	const mask = "REDACTED"
+	if len(ep.Secret) > 0 {
+		ep.Secret = mask
+	}
+	if len(ep.OutboundSecret) > 0 {
+		ep.OutboundSecret = mask
+	}
+	if ep.Env != nil {
+		env := make([]string, len(ep.Env))
+		for i, kv := range ep.Env {
+			k, _, _ := strings.Cut(kv, "=")
+			env[i] = k + "=" + mask
+		}
+		ep.Env = env
+	}
+	if ep.Forward != nil {
+		urls := make([]string, len(ep.Forward))
+		for i, u := range ep.Forward {
+			urls[i] = redactedURL(u)
+		}
+		ep.Forward = urls
+	}
+	if len(ep.Callback) > 0 {
+		ep.Callback = redactedURL(ep.Callback)
+	}
+	if ep.Refs != nil {
+		refs := make(map[string]refConfig, len(ep.Refs))
+		for k, c := range ep.Refs {
+			if len(c.Secret) > 0 {
+				c.Secret = mask
+			}
+			refs[k] = c
+		}
+		ep.Refs = refs
+	}
+	for _, c := range []**refConfig{&ep.OnBranch, &ep.OnTag} {
+		if *c != nil && len((*c).Secret) > 0 {
+			cc := **c
+			cc.Secret = mask
+			*c = &cc
+		}
+	}
+	if ep.Repos != nil {
+		repos := make(map[string]endpoint, len(ep.Repos))
+		for k, repo := range ep.Repos {
+			repos[k] = repo.redacted()
+		}
+		ep.Repos = repos
+	}
+	return ep
+}
+
+// redactedURL returns s with userinfo and query removed, as these may carry
+// credentials
+func redactedURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "REDACTED"
+	}
+	u.User = nil
+	u.RawQuery = ""
+	u.ForceQuery = false
+	u.Fragment, u.RawFragment = "", ""
+	return u.String()
+}
+
+// checkClientCerts returns error if any endpoint requires client
+// certificates, but there is no CA to verify them against, as endpoint would
+// reject every delivery then
+func checkClientCerts(cfg map[string]endpoint, haveCA bool) error {
+	if haveCA {
+		return nil
+	}
+	for k, ep := range cfg {
+		if ep.RequireClientCert {
+			return fmt.Errorf("%s: requireclientcert needs -client-ca", k)
+		}
+	}
+	return nil
+}
+
+// checkTarget verifies that delivery is intended for the hook or app endpoint
+// is configured for
+func (ep endpoint) checkTarget(h http.Header) error {
+	if v := h.Get("X-Github-Hook-Installation-Target-Type"); len(ep.TargetType) > 0 && v != ep.TargetType {
+		return fmt.Errorf("hook target type mismatch: got %q, want %q", v, ep.TargetType)
+	}
+	if v := h.Get("X-Github-Hook-Installation-Target-Id"); len(ep.TargetID) > 0 && v != ep.TargetID {
+		return fmt.Errorf("hook target id mismatch: got %q, want %q", v, ep.TargetID)
+	}
+	return nil
+}
+
+// allowsAlgorithm reports whether endpoint accepts signatures made with
+// given algorithm
+func (ep endpoint) allowsAlgorithm(algo string) bool {
+	if len(ep.Algorithms) == 0 {
+		return true
+	}
+	for _, a := range ep.Algorithms {
+		if a == algo {
+			return true
+		}
+	}
+	return false
+}
+
+// hasCommand reports whether endpoint may run any command for given ref
+func (ep endpoint) hasCommand(ref string) bool {
+	if len(ep.Dispatcher) > 0 || len(ep.Routes) > 0 ||
+		((len(ep.Command) > 0 || len(ep.Exec) > 0) && ep.globalAllowed(ref)) {
+		return true
+	}
+	_, ok := ep.refRule(ref)
+	return ok
+}
+
+// commands returns names of all commands endpoint may run, including
+// dispatcher and per-ref and per-repository ones
+func (ep endpoint) commands() []string {
+	var out []string
+	add := func(list []string, command string) {
+		if name, _ := argv(list, command, nil); len(name) > 0 {
+			out = append(out, name)
+		}
+	}
+	add(ep.Exec, ep.Command)
+	add(nil, ep.Dispatcher)
+	for _, r := range ep.Routes {
+		add(r.Exec, r.Command)
+	}
+	for _, c := range ep.Refs {
+		add(c.Exec, c.Command)
+	}
+	for _, c := range []*refConfig{ep.OnBranch, ep.OnTag} {
+		if c != nil {
+			add(c.Exec, c.Command)
+		}
+	}
+	for _, repo := range ep.Repos {
+		out = append(out, repo.commands()...)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// forRepo returns copy of app endpoint with command configuration replaced by
+// the one from its per-repository config
+func (ep endpoint) forRepo(repo endpoint) endpoint {
+	ep.Command, ep.Args, ep.Exec = repo.Command, repo.Args, repo.Exec
+	ep.CommandRefs = repo.CommandRefs
+	ep.Dispatcher = repo.Dispatcher
+	ep.When, ep.when, ep.Routes = repo.When, repo.when, repo.Routes
+	ep.Refs = repo.Refs
+	ep.OnBranch, ep.OnTag = repo.OnBranch, repo.OnTag
+	ep.AppMode, ep.Repos = false, nil
+	return ep
+}
+
+// accepts reports whether endpoint is configured to accept given event type
+func (ep endpoint) accepts(event string) bool {
+	if len(ep.Events) == 0 {
+		return event == "push"
+	}
+	for _, e := range ep.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// globalAllowed reports whether global command may run for ref
+func (ep endpoint) globalAllowed(ref string) bool {
+	if len(ep.CommandRefs) == 0 {
+		return true
+	}
+	for _, p := range ep.CommandRefs {
+		if ok, _ := path.Match(p, ref); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// refRule returns per-ref config matching given ref. Exact match takes
+// precedence, then glob patterns are checked, then rules with branch regex;
+// both patterns and regex rules are checked in lexical order of their keys.
+func (ep endpoint) refRule(ref string) (refConfig, bool) {
+	if c, ok := ep.Refs[ref]; ok && c.branchRe == nil {
+		return c, true
+	}
+	keys := make([]string, 0, len(ep.Refs))
+	for k := range ep.Refs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if c := ep.Refs[k]; c.branchRe == nil && isGlob(k) {
+			if ok, _ := path.Match(k, ref); ok {
+				return c, true
+			}
+		}
+	}
+	kind, name := refKind(ref)
+	if kind == "branch" {
+		for _, k := range keys {
+			if c := ep.Refs[k]; c.branchRe != nil && c.branchRe.MatchString(name) {
+				return c, true
+			}
+		}
+	}
+	switch {
+	case kind == "branch" && ep.OnBranch != nil:
+		return *ep.OnBranch, true
+	case kind == "tag" && ep.OnTag != nil:
+		return *ep.OnTag, true
+	}
+	return refConfig{}, false
+}
+
+// checkRef returns the reason ref looks suspicious, or empty string if it
+// doesn't. Refs are expected to be branches or tags named with characters
+// that need no quoting in shell, so that they are safe to use in commands.
+func checkRef(ref string) string {
+	kind, name := refKind(ref)
+	switch {
+	case len(kind) == 0:
+		return "neither a branch nor a tag"
+	case len(name) == 0:
+		return "empty name"
+	case strings.HasPrefix(name, "-"):
+		return "name starts with dash"
+	case strings.Contains(name, ".."):
+		return "name has double dot"
+	}
+	for _, r := range name {
+		if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' ||
+			strings.ContainsRune("._-/+@=,", r)) {
+			return fmt.Sprintf("name has unexpected character %q", r)
+		}
+	}
+	return ""
+}
+
+// refKind classifies ref as either "branch" or "tag" by its prefix, returning
+// short name of the branch or tag. For other refs it returns empty kind.
+func refKind(ref string) (kind, name string) {
+	switch {
+	case strings.HasPrefix(ref, "refs/heads/"):
+		return "branch", strings.TrimPrefix(ref, "refs/heads/")
+	case strings.HasPrefix(ref, "refs/tags/"):
+		return "tag", strings.TrimPrefix(ref, "refs/tags/")
+	}
+	return "", ref
+}
+
+// checkPatterns verifies that list only holds valid path.Match patterns
+func checkPatterns(list []string) error {
+	for _, p := range list {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("%q: %v", p, err)
+		}
+	}
+	return nil
+}
+
+// isGlob reports whether s contains glob pattern metacharacters
+func isGlob(s string) bool { return strings.ContainsAny(s, "*?[") }
+
+// refConfig represents per-ref part of endpoint config
+type refConfig struct {
+	Command string // per-ref commands
+	Args    []string
+	Exec    []string // alternative to Command and Args, command goes first
+	Secret  string   // if set, used instead of endpoint secret for this ref
+	// BranchRegex, if set, makes rule match branches by regular expression
+	// instead of its key
+	BranchRegex string
+
+	branchRe *regexp.Regexp
+}
+
+// maxSuccessBody limits size of endpoint success body
+const maxSuccessBody = 1 << 10
+
+// defaultEndpoint is a config key of endpoint handling requests to paths no
+// other endpoint is configured for
+const defaultEndpoint = "*"
+
+// defaultsKey is the top-level config key of settings all endpoints inherit
+const defaultsKey = "defaults"
+
+// readConfig loads configuration from yaml file
+//
+// Config should be in form map[string]endpoint, where keys are urls used to set
+// up http handlers. Optional defaults block holds settings inherited by all
+// endpoints not setting them explicitly.
+func readConfig(fileName string, allowed commandPolicy) (map[string]endpoint, error) {
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if b, err = applyDefaults(b); err != nil {
+		return nil, err
+	}
+	out := make(map[string]endpoint)
+	if err := yaml.Unmarshal(b, out); err != nil {
+		return nil, err
+	}
+	return checkConfig(out, allowed)
+}
+
+// defaultGroups lists settings that are alternatives to each other, or can't
+// be used together; each group is inherited from defaults block as a whole,
+// only if endpoint sets none of its keys
+var defaultGroups = [][]string{
+	{"command", "args", "exec"},
+	{"reponame", "reponames", "repoid", "org"},
+	{"secret", "secret_command", "secret_rotated_at"},
+	{"rejectbusy", "batchinterval"},
+}
+
+// applyDefaults returns config with top-level settings of defaults block
+// copied to every endpoint not having them set, and the block removed
+func applyDefaults(b []byte) ([]byte, error) {
+	var tree map[string]interface{}
+	if err := yaml.Unmarshal(b, &tree); err != nil {
+		return nil, err
+	}
+	v, ok := tree[defaultsKey]
+	if !ok {
+		return b, nil
+	}
+	delete(tree, defaultsKey)
+	defaults, ok := v.(map[interface{}]interface{})
+	if !ok && v != nil {
+		return nil, fmt.Errorf("%s: not a mapping", defaultsKey)
+	}
+	for k, v := range tree {
+		ep, ok := v.(map[interface{}]interface{})
+		switch {
+		case v == nil:
+			ep = make(map[interface{}]interface{})
+		case !ok:
+			continue // left for endpoint decoding to report
+		}
+		skip := make(map[interface{}]bool)
+		for _, group := range defaultGroups {
+			for _, key := range group {
+				if _, ok := ep[key]; ok {
+					for _, key := range group {
+						skip[key] = true
+					}
+					break
+				}
+			}
+		}
+		for dk, dv := range defaults {
+			if _, ok := ep[dk]; !ok && !skip[dk] {
+				ep[dk] = dv
+			}
+		}
+		tree[k] = ep
+	}
+	return yaml.Marshal(tree)
+}
+
+// envConfig builds single-endpoint configuration from GHWH_REPO, GHWH_SECRET,
+// GHWH_COMMAND and GHWH_PATH environment variables, for deployments with no
+// config file. GHWH_SECRET is removed from the environment, so that it's not
+// inherited by commands.
+func envConfig(allowed commandPolicy) (map[string]endpoint, error) {
+	repo := os.Getenv("GHWH_REPO")
+	if len(repo) == 0 {
+		return nil, errors.New("neither -config nor GHWH_REPO environment variable is set")
+	}
+	path := os.Getenv("GHWH_PATH")
+	if len(path) == 0 {
+		path = "/"
+	}
+	ep := endpoint{
+		RepoName: repo,
+		Secret:   os.Getenv("GHWH_SECRET"),
+		Exec:     strings.Fields(os.Getenv("GHWH_COMMAND")),
+	}
+	os.Unsetenv("GHWH_SECRET")
+	return checkConfig(map[string]endpoint{path: ep}, allowed)
+}
+
+// checkConfig validates endpoints configuration and initializes their
+// internal fields. Endpoints running commands not allowed by policy are
+// rejected before any of their commands is run.
+func checkConfig(out map[string]endpoint, allowed commandPolicy) (map[string]endpoint, error) {
+	if _, ok := out[defaultEndpoint]; ok {
+		if _, ok := out["/"]; ok {
+			return nil, fmt.Errorf("both %q and \"/\" endpoints are configured", defaultEndpoint)
+		}
+	}
+	for k, ep := range out {
+		for _, e := range ep.Events {
+			if _, ok := parsers[e]; !ok {
+				return nil, fmt.Errorf("%s: unsupported event type %q", k, e)
+			}
+		}
+		if err := checkExec(ep.Exec, ep.Command); err != nil {
+			return nil, fmt.Errorf("%s: %v", k, err)
+		}
+		if err := allowed.check(ep); err != nil {
+			return nil, fmt.Errorf("%s: %v", k, err)
+		}
+		if t := ep.SecretRotatedAt; t != nil && t.After(time.Now()) {
+			return nil, fmt.Errorf("%s: secret_rotated_at is in the future", k)
+		}
+		if len(ep.SecretCommand) > 0 {
+			if len(ep.Secret) > 0 {
+				return nil, fmt.Errorf("%s: both secret and secret_command are set", k)
+			}
+			secret, err := commandSecret(ep.SecretCommand)
+			if err != nil {
+				return nil, fmt.Errorf("%s: secret_command: %v", k, err)
+			}
+			ep.Secret = secret
+		}
+		if err := initRefs(ep.Refs); err != nil {
+			return nil, fmt.Errorf("%s: %v", k, err)
+		}
+		if err := checkRefKinds(ep); err != nil {
+			return nil, fmt.Errorf("%s: %v", k, err)
+		}
+		if err := initExprs(&ep); err != nil {
+			return nil, fmt.Errorf("%s: %v", k, err)
+		}
+		if ep.CallbackOutput < 0 {
+			return nil, fmt.Errorf("%s: negative callbackoutput", k)
+		}
+		if ep.CallbackOutput > 0 && len(ep.Callback) == 0 {
+			return nil, fmt.Errorf("%s: callbackoutput needs callback", k)
+		}
+		switch ep.RefQueuePolicy {
+		case "", "reject", "dropoldest":
+		default:
+			return nil, fmt.Errorf("%s: unsupported refqueuepolicy %q", k, ep.RefQueuePolicy)
+		}
+		if ep.RejectBusy && ep.BatchInterval > 0 {
+			return nil, fmt.Errorf("%s: rejectbusy cannot be used with batchinterval", k)
+		}
+		if len(ep.RepoName) > 0 && len(ep.RepoNames) > 0 {
+			return nil, fmt.Errorf("%s: both reponame and reponames are set", k)
+		}
+		if err := checkPatterns(ep.CommandRefs); err != nil {
+			return nil, fmt.Errorf("%s: command refs: %v", k, err)
+		}
+		if len(ep.RunnerPrefix) > 0 && len(ep.RunnerPrefix[0]) == 0 {
+			return nil, fmt.Errorf("%s: runner prefix: empty command", k)
+		}
+		for _, a := range ep.Algorithms {
+			if _, ok := hashes[a]; !ok {
+				return nil, fmt.Errorf("%s: unsupported signature algorithm %q", k, a)
+			}
+		}
+		if len(ep.SignatureHeader) > 0 && len(ep.Algorithms) > 1 {
+			return nil, fmt.Errorf("%s: custom signature header needs a single algorithm", k)
+		}
+		switch ep.DisabledStatus {
+		case 0, http.StatusNotFound, http.StatusServiceUnavailable:
+		default:
+			return nil, fmt.Errorf("%s: unsupported disabled status %d", k, ep.DisabledStatus)
+		}
+		switch ep.SuccessStatus {
+		case 0, http.StatusOK, http.StatusAccepted, http.StatusNoContent:
+		default:
+			return nil, fmt.Errorf("%s: unsupported success status %d", k, ep.SuccessStatus)
+		}
+		switch {
+		case len(ep.SuccessBody) > maxSuccessBody:
+			return nil, fmt.Errorf("%s: success body is longer than %d bytes", k, maxSuccessBody)
+		case len(ep.SuccessBody) > 0 && ep.SuccessStatus == http.StatusNoContent:
+			return nil, fmt.Errorf("%s: success body cannot be used with %d status", k, ep.SuccessStatus)
+		}
+		if ep.AppMode && len(ep.Secret) == 0 {
+			return nil, fmt.Errorf("%s: app mode requires secret", k)
+		}
+		for name, repo := range ep.Repos {
+			if err := checkExec(repo.Exec, repo.Command); err != nil {
+				return nil, fmt.Errorf("%s: %s: %v", k, name, err)
+			}
+			if err := initRefs(repo.Refs); err != nil {
+				return nil, fmt.Errorf("%s: %s: %v", k, name, err)
+			}
+			if err := checkRefKinds(repo); err != nil {
+				return nil, fmt.Errorf("%s: %s: %v", k, name, err)
+			}
+			if err := initExprs(&repo); err != nil {
+				return nil, fmt.Errorf("%s: %s: %v", k, name, err)
+			}
+			if err := checkPatterns(repo.CommandRefs); err != nil {
+				return nil, fmt.Errorf("%s: %s: command refs: %v", k, name, err)
+			}
+			ep.Repos[name] = repo
+		}
+		for _, kv := range ep.Env {
+			if i := strings.IndexByte(kv, '='); i < 1 {
+				return nil, fmt.Errorf("%s: env %q is not in KEY=value form", k, kv)
+			}
+		}
+		if ep.Limits != nil {
+			if err := ep.Limits.validate(); err != nil {
+				return nil, fmt.Errorf("%s: limits: %v", k, err)
+			}
+		}
+		if len(ep.ErrorBody) > 0 {
+			t, err := template.New("").Parse(ep.ErrorBody)
+			if err == nil {
+				err = t.Execute(io.Discard, errorData{})
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: error body: %v", k, err)
+			}
+			ep.errorBody = t
+		}
+		if len(ep.Schema) > 0 {
+			sch, err := jsonschema.NewCompiler().Compile(ep.Schema)
+			if err != nil {
+				return nil, fmt.Errorf("%s: schema: %v", k, err)
+			}
+			ep.schema = sch
+		}
+		if ep.AllowedSchedule != nil {
+			if err := ep.AllowedSchedule.init(); err != nil {
+				return nil, fmt.Errorf("%s: schedule: %v", k, err)
+			}
+		}
+		ep.path = k
+		out[k] = ep
+	}
+	return out, nil
+}
+
+// checkRefKinds validates endpoint on_branch and on_tag rules
+func checkRefKinds(ep endpoint) error {
+	for name, c := range map[string]*refConfig{"on_branch": ep.OnBranch, "on_tag": ep.OnTag} {
+		if c == nil {
+			continue
+		}
+		if err := checkExec(c.Exec, c.Command); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if len(c.BranchRegex) > 0 {
+			return fmt.Errorf("%s: branchregex cannot be used here", name)
+		}
+	}
+	return nil
+}
+
+// initRefs validates per-ref configs and compiles their regular expressions
+func initRefs(refs map[string]refConfig) error {
+	for ref, c := range refs {
+		if err := checkExec(c.Exec, c.Command); err != nil {
+			return fmt.Errorf("%s: %v", ref, err)
+		}
+		switch {
+		case len(c.BranchRegex) > 0:
+			re, err := regexp.Compile(c.BranchRegex)
+			if err != nil {
+				return fmt.Errorf("%s: %v", ref, err)
+			}
+			c.branchRe = re
+			refs[ref] = c
+		case isGlob(ref):
+			if _, err := path.Match(ref, ""); err != nil {
+				return fmt.Errorf("%s: %v", ref, err)
+			}
+		}
+	}
+	return nil
+}
+
+// compactYAML marshals v to YAML omitting unset values: nil pointers, slices
+// and maps, and zero values of other types. Values set through pointers,
+// slices and maps are kept even if they are empty or zero, as they differ from
+// unset ones, i.e. "enabled: false" or "runnerprefix: []".
+func compactYAML(v interface{}) ([]byte, error) {
+	tree, _ := compact(reflect.ValueOf(v), true)
+	return yaml.Marshal(tree)
+}
+
+// compact converts v to a tree of maps, slices and values for compactYAML,
+// it returns false if v is unset and should be omitted, unless keep is set
+func compact(v reflect.Value, keep bool) (interface{}, bool) {
+	switch v.Kind() {
+	case reflect.Invalid:
+		return nil, false
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil, false
+		}
+		return compact(v.Elem(), true)
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil, false
+		}
+		out := make([]interface{}, v.Len())
+		for i := range out {
+			out[i], _ = compact(v.Index(i), true)
+		}
+		return out, true
+	case reflect.Map:
+		if v.IsNil() {
+			return nil, false
+		}
+		out := make(map[string]interface{}, v.Len())
+		for it := v.MapRange(); it.Next(); {
+			out[fmt.Sprint(it.Key().Interface())], _ = compact(it.Value(), true)
+		}
+		return out, true
+	case reflect.Struct:
+		if _, ok := v.Interface().(time.Time); ok {
+			return v.Interface(), keep || !v.IsZero()
+		}
+		out := make(map[string]interface{})
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+			switch name {
+			case "-":
+				continue
+			case "":
+				name = strings.ToLower(f.Name)
+			}
+			if val, ok := compact(v.Field(i), false); ok {
+				out[name] = val
+			}
+		}
+		return out, keep || len(out) > 0
+	}
+	return v.Interface(), keep || !v.IsZero()
+}
+
+// checkExec validates exec list, which must not be used together with command
+func checkExec(list []string, command string) error {
+	switch {
+	case len(list) == 0:
+		return nil
+	case len(list[0]) == 0:
+		return errors.New("exec: empty command")
+	case len(command) > 0:
+		return errors.New("both exec and command are set")
+	}
+	return nil
+}
+
+// secretCommandTimeout limits run time of secret_command
+const secretCommandTimeout = 30 * time.Second
+
+// commandSecret runs command and returns its output with trailing newline
+// removed as a secret
+func commandSecret(argv []string) (string, error) {
+	if len(argv[0]) == 0 {
+		return "", errors.New("empty command")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), secretCommandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimRight(string(out), "\r\n")
+	if len(secret) == 0 {
+		return "", errors.New("command printed no secret")
+	}
+	return secret, nil
+}
+
+// argv returns command name and its arguments, taking them from exec list if
+// it is not empty
+func argv(list []string, command string, args []string) (string, []string) {
+	if len(list) > 0 {
+		return list[0], list[1:]
+	}
+	return command, args
 }
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestValidSignatureCase(t *testing.T) {
+	secret := []byte("s3cret")
+	body := []byte(`{"ref":"refs/heads/master"}`)
+	mixed := func(s string) string {
+		b := []byte(s)
+		for i := 0; i < len(b); i += 2 {
+			b[i] = strings.ToUpper(string(b[i]))[0]
+		}
+		return string(b)
+	}
+	for _, algo := range []string{"sha1", "sha256"} {
+		sig := hmacHex(algo, secret, body)
+		if strings.ToUpper(sig) == sig || mixed(sig) == sig {
+			t.Fatalf("%s: signature %s has no letters to change case of", algo, sig)
+		}
+		for _, tc := range []struct {
+			name string
+			sig  string
+			want bool
+		}{
+			{"lowercase", sig, true},
+			{"uppercase", strings.ToUpper(sig), true},
+			{"mixed case", mixed(sig), true},
+			{"mismatch", hmacHex(algo, []byte("other"), body), false},
+			{"malformed", "zz" + sig[2:], false},
+		} {
+			if got := validSignature(algo, secret, tc.sig, body); got != tc.want {
+				t.Errorf("%s, %s: validSignature(%q) = %v, want %v",
+					algo, tc.name, tc.sig, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestReloadKeepsQueuedJob(t *testing.T) {
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "ran")
+	cfgFile := filepath.Join(dir, "config.yaml")
+	writeConfig := func(s string) {
+		t.Helper()
+		if err := os.WriteFile(cfgFile, []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(fmt.Sprintf("/removed:\n  reponame: ghwh\n  secret: s3cret\n  exec: [touch, %q]\n", marker))
+	cfg, err := readConfig(cfgFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, kill := context.WithCancel(context.Background())
+	defer kill()
+	h := &hookHandler{
+		queue:    newJobQueue(1, false),
+		timeout:  time.Minute,
+		quiet:    true,
+		base:     base,
+		kill:     kill,
+		drain:    make(chan struct{}),
+		done:     make(chan struct{}),
+		stats:    newStatsRegistry(),
+		metrics:  newMetrics(),
+		deployed: newDeployLog(),
+	}
+	h.configure(cfg)
+
+	deliver := func() int {
+		body := []byte(`{"ref":"refs/heads/master","repository":{"name":"ghwh"}}`)
+		r := httptest.NewRequest(http.MethodPost, "/removed", bytes.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("X-Github-Event", "push")
+		r.Header.Set("X-Hub-Signature-256", "sha256="+hmacHex("sha256", []byte("s3cret"), body))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	// worker is not running yet, so job stays queued over reload
+	if code := deliver(); code != http.StatusOK {
+		t.Fatalf("delivery before reload: got status %d", code)
+	}
+	writeConfig("/other:\n  reponame: other\n  command: /bin/true\n")
+	if err := h.reload(cfgFile); err != nil {
+		t.Fatal(err)
+	}
+	if code := deliver(); code != http.StatusNotFound {
+		t.Fatalf("delivery to removed endpoint: got status %d, want %d", code, http.StatusNotFound)
+	}
+	go h.run()
+	h.shutdown(time.Minute)
+	if _, err := os.Stat(marker); err != nil {
+		t.Fatalf("queued job of removed endpoint did not run: %v", err)
+	}
+}
+
+func TestPrintConfigKeepsExplicitValues(t *testing.T) {
+	cfgFile := filepath.Join(t.TempDir(), "config.yaml")
+	const src = "/hook:\n  reponame: ghwh\n  command: /bin/true\n" +
+		"  enabled: false\n  signatureprefix: \"\"\n  runnerprefix: []\n"
+	if err := os.WriteFile(cfgFile, []byte(src), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := readConfig(cfgFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := compactYAML(redactedConfig(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out map[string]endpoint
+	if err := yaml.Unmarshal(b, &out); err != nil {
+		t.Fatalf("printed config %q: %v", b, err)
+	}
+	ep := out["/hook"]
+	if ep.Enabled == nil || *ep.Enabled {
+		t.Errorf("enabled is not kept false in printed config:\n%s", b)
+	}
+	if ep.SignaturePrefix == nil || *ep.SignaturePrefix != "" {
+		t.Errorf("signatureprefix is not kept empty in printed config:\n%s", b)
+	}
+	if ep.RunnerPrefix == nil || len(ep.RunnerPrefix) != 0 {
+		t.Errorf("runnerprefix is not kept empty in printed config:\n%s", b)
+	}
+}
+
+func TestQueueShrinkKeepsJobs(t *testing.T) {
+	ep := endpoint{path: "/hook", RefQueueLimit: 1, RefQueuePolicy: "dropoldest"}
+	job := func(id string) execEnv {
+		return execEnv{endpoint: ep, requestID: id, payload: hookPayload{Ref: "refs/heads/master"}}
+	}
+	q := newJobQueue(3, false)
+	for _, id := range []string{"1", "2", "3"} {
+		if !q.push(job(id)) {
+			t.Fatalf("push %s: queue is full", id)
+		}
+	}
+	if !q.resize(1) {
+		t.Fatal("resize: size unchanged")
+	}
+	if q.push(job("4")) {
+		t.Fatal("push over shrunk size succeeded")
+	}
+	if dropped, err := q.pushRef(context.Background(), job("4"), false); err != errQueueFull || dropped != nil {
+		t.Fatalf("dropoldest push over shrunk size: got %v, %v, want errQueueFull", dropped, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if q.pushWait(ctx, job("4")) {
+		t.Fatal("pushWait over shrunk size succeeded")
+	}
+	if item, ok := q.pop(); !ok || item.requestID != "1" {
+		t.Fatalf("pop: got %q, %v, want %q", item.requestID, ok, "1")
+	}
+	if dropped, err := q.pushRef(context.Background(), job("4"), false); err != errQueueFull || dropped != nil {
+		t.Fatalf("dropoldest push with 2 jobs over size 1: got %v, %v, want errQueueFull", dropped, err)
+	}
+	if item, ok := q.pop(); !ok || item.requestID != "2" {
+		t.Fatalf("pop: got %q, %v, want %q", item.requestID, ok, "2")
+	}
+	dropped, err := q.pushRef(context.Background(), job("4"), false)
+	if err != nil || dropped == nil || dropped.requestID != "3" {
+		t.Fatalf("dropoldest push at size: got %v, %v, want job 3 dropped", dropped, err)
+	}
+	if item, ok := q.pop(); !ok || item.requestID != "4" {
+		t.Fatalf("pop: got %q, %v, want %q", item.requestID, ok, "4")
+	}
+	if q.len() != 0 {
+		t.Fatalf("queue has %d jobs left, want 0", q.len())
+	}
+}
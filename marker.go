@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// deployMarker describes the last successful run of endpoint command
+type deployMarker struct {
+	Repo      string    `json:"repo"`
+	Ref       string    `json:"ref"`
+	SHA       string    `json:"sha,omitempty"` // not set for events without one
+	RequestID string    `json:"request_id"`
+	Time      time.Time `json:"time"`
+}
+
+// markDeployed records successful run of job in endpoint stats and, if
+// endpoint has marker file set, writes it there
+func (hh *hookHandler) markDeployed(item execEnv) error {
+	m := deployMarker{
+		Repo:      item.payload.Repository.FullName,
+		Ref:       item.payload.Ref,
+		SHA:       item.payload.After,
+		RequestID: item.requestID,
+		Time:      time.Now().UTC(),
+	}
+	if pr := item.payload.PullRequest; pr != nil && pr.Merged {
+		m.SHA = pr.MergeCommitSha
+	}
+	hh.stats.update(item.endpoint.path, func(st *endpointStats) { st.LastDeploy = &m })
+	if len(item.endpoint.MarkerFile) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(item.endpoint.MarkerFile, append(b, '\n'))
+}
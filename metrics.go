@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// metrics holds counters exposed in Prometheus text format
+type metrics struct {
+	mu       sync.Mutex
+	counters map[metricKey]uint64
+}
+
+type metricKey struct {
+	name   string
+	labels string // rendered label set, like `endpoint="/hook1",event="push"`
+}
+
+// metricHelp holds descriptions of all known metrics
+var metricHelp = map[string]string{
+	"ghwh_deliveries_total": "Number of accepted deliveries.",
+	"ghwh_runs_total":       "Number of processed jobs by result.",
+}
+
+func newMetrics() *metrics {
+	return &metrics{counters: make(map[metricKey]uint64)}
+}
+
+// inc increments counter with given name and label name/value pairs
+func (m *metrics) inc(name string, labels ...string) {
+	var b strings.Builder
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1]))
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[metricKey{name, b.String()}]++
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeTo writes all counters to w in Prometheus text exposition format
+func (m *metrics) writeTo(w io.Writer) {
+	m.mu.Lock()
+	keys := make([]metricKey, 0, len(m.counters))
+	for k := range m.counters {
+		keys = append(keys, k)
+	}
+	values := make(map[metricKey]uint64, len(keys))
+	for _, k := range keys {
+		values[k] = m.counters[k]
+	}
+	m.mu.Unlock()
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].name != keys[j].name {
+			return keys[i].name < keys[j].name
+		}
+		return keys[i].labels < keys[j].labels
+	})
+	var last string
+	for _, k := range keys {
+		if k.name != last {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", k.name, metricHelp[k.name], k.name)
+			last = k.name
+		}
+		fmt.Fprintf(w, "%s{%s} %d\n", k.name, k.labels, values[k])
+	}
+}
+
+// metricLabels returns label pairs for metrics of given endpoint. Ref label
+// is only added if endpoint enables it, as number of refs is unbounded.
+func metricLabels(ep endpoint, event, ref string, extra ...string) []string {
+	out := []string{"endpoint", ep.path, "event", event}
+	if ep.MetricsByRef {
+		out = append(out, "ref", ref)
+	}
+	return append(out, extra...)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// lineWriter logs every line written to it, prepending it with prefix. Flush
+// must be called once writes are done to log the trailing incomplete line.
+type lineWriter struct {
+	prefix string
+	enc    string        // invalid UTF-8 handling, see sanitizeUTF8
+	wait   time.Duration // if positive, incomplete line is logged once pending that long
+
+	mu    sync.Mutex
+	buf   []byte
+	timer *time.Timer // flushes incomplete line pending for wait
+}
+
+// maxLineSize is the size of incomplete line lineWriter buffers before logging
+// it anyway
+const maxLineSize = 64 << 10
+
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	lw.buf = append(lw.buf, p...)
+	for {
+		i := bytes.IndexByte(lw.buf, '\n')
+		if i < 0 {
+			break
+		}
+		// terminal line endings are \r\n
+		log.Print(lw.prefix, sanitizeUTF8(bytes.TrimSuffix(lw.buf[:i], []byte("\r")), lw.enc))
+		lw.buf = lw.buf[i+1:]
+	}
+	if len(lw.buf) >= maxLineSize {
+		lw.flush()
+	}
+	switch {
+	case len(lw.buf) == 0 && lw.timer != nil:
+		lw.timer.Stop()
+		lw.timer = nil
+	case len(lw.buf) > 0 && lw.timer == nil && lw.wait > 0:
+		lw.timer = time.AfterFunc(lw.wait, lw.Flush)
+	}
+	return len(p), nil
+}
+
+// Flush logs buffered incomplete line, if any
+func (lw *lineWriter) Flush() {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	if lw.timer != nil {
+		lw.timer.Stop()
+		lw.timer = nil
+	}
+	lw.flush()
+}
+
+func (lw *lineWriter) flush() {
+	if len(lw.buf) == 0 {
+		return
+	}
+	log.Print(lw.prefix, sanitizeUTF8(lw.buf, lw.enc))
+	lw.buf = nil
+}
+
+// defaultMaxOutput is the default limit of output of a single command run
+// written to endpoint log file
+const defaultMaxOutput = 10 << 20
+
+// limitWriter passes up to n bytes to w, then writes truncation notice
+// and discards the rest
+type limitWriter struct {
+	w         io.Writer
+	n         int64
+	truncated bool
+}
+
+func (lw *limitWriter) Write(p []byte) (int, error) {
+	if lw.truncated {
+		return len(p), nil
+	}
+	if int64(len(p)) <= lw.n {
+		n, err := lw.w.Write(p)
+		lw.n -= int64(n)
+		return n, err
+	}
+	n, err := lw.w.Write(p[:lw.n])
+	lw.n -= int64(n)
+	if err != nil {
+		return n, err
+	}
+	lw.truncated = true
+	if _, err := fmt.Fprintf(lw.w, "\n# output truncated, limit reached\n"); err != nil {
+		return n, err
+	}
+	return len(p), nil
+}
+
+// sanitizeUTF8 returns b as a string with invalid UTF-8 bytes handled
+// according to enc: "replace" substitutes each with U+FFFD, "escape" writes
+// them as \xNN, anything else keeps them as is
+func sanitizeUTF8(b []byte, enc string) string {
+	if (enc != "replace" && enc != "escape") || utf8.Valid(b) {
+		return string(b)
+	}
+	var sb strings.Builder
+	for len(b) > 0 {
+		r, size := utf8.DecodeRune(b)
+		switch {
+		case r != utf8.RuneError || size > 1:
+			sb.Write(b[:size])
+		case enc == "escape":
+			fmt.Fprintf(&sb, "\\x%02x", b[0])
+		default:
+			sb.WriteRune(utf8.RuneError)
+		}
+		b = b[size:]
+	}
+	return sb.String()
+}
+
+// utf8Writer passes writes to w with invalid UTF-8 handled as sanitizeUTF8
+// does. Incomplete trailing sequence is held until the next write, so that
+// characters split between writes are kept intact; Flush must be called once
+// writes are done.
+type utf8Writer struct {
+	w       io.Writer
+	enc     string
+	pending []byte
+}
+
+func (uw *utf8Writer) Write(p []byte) (int, error) {
+	buf := append(uw.pending, p...)
+	n := len(buf)
+	for i := len(buf) - 1; i >= 0 && i > len(buf)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(buf[i]) {
+			if !utf8.FullRune(buf[i:]) {
+				n = i
+			}
+			break
+		}
+	}
+	uw.pending = append([]byte(nil), buf[n:]...)
+	if _, err := io.WriteString(uw.w, sanitizeUTF8(buf[:n], uw.enc)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes held incomplete sequence, if any
+func (uw *utf8Writer) Flush() {
+	if len(uw.pending) == 0 {
+		return
+	}
+	io.WriteString(uw.w, sanitizeUTF8(uw.pending, uw.enc))
+	uw.pending = nil
+}
+
+// maxTailSize limits size of command output tail kept by tailWriter
+const maxTailSize = 4 << 10
+
+// tailWriter keeps the last n lines written to it, up to maxTailSize bytes.
+// It's safe for concurrent use, so it can be shared by stdout and stderr.
+type tailWriter struct {
+	mu  sync.Mutex
+	n   int
+	buf []byte
+}
+
+func (tw *tailWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.buf = append(tw.buf, p...)
+	if len(tw.buf) > maxTailSize {
+		tw.buf = append(tw.buf[:0], tw.buf[len(tw.buf)-maxTailSize:]...)
+	}
+	return len(p), nil
+}
+
+// String returns up to n last lines written
+func (tw *tailWriter) String() string {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	lines := bytes.Split(bytes.TrimSuffix(tw.buf, []byte("\n")), []byte("\n"))
+	if len(lines) > tw.n {
+		lines = lines[len(lines)-tw.n:]
+	}
+	return string(bytes.Join(lines, []byte("\n")))
+}
+
+// teeWriter returns writer passing writes to both w and tw, w may be nil
+func teeWriter(w io.Writer, tw *tailWriter) io.Writer {
+	if w == nil {
+		return tw
+	}
+	return io.MultiWriter(w, tw)
+}
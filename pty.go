@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io"
+	"os/exec"
+	"time"
+
+	"github.com/creack/pty"
+)
+
+// startPTY starts cmd attached to a new pseudo-terminal, copying its output
+// to cmd.Stdout. Both output streams go there, as terminal merges them.
+// Returned function must be called once cmd exits: it waits for output
+// copying to finish and closes the terminal.
+func startPTY(cmd *exec.Cmd) (func(), error) {
+	out := cmd.Stdout
+	if out == nil {
+		out = io.Discard
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = nil, nil, nil
+	tty, err := pty.Start(cmd)
+	if err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(out, tty)
+	}()
+	return func() {
+		// processes command left in background may keep terminal open,
+		// don't wait for them for long
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+		}
+		tty.Close()
+		<-done
+	}, nil
+}
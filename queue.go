@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+)
+
+// jobQueue holds jobs waiting to be run. In fair mode it keeps separate queue
+// per endpoint and picks jobs from them in round-robin, so that busy endpoint
+// cannot starve others; otherwise jobs are picked in order they were pushed.
+type jobQueue struct {
+	notify chan struct{} // signalled on each push
+	space  chan struct{} // signalled when queue has free slot, see pushWait
+	fair   bool
+	size   int // maximum number of queued jobs
+
+	mu     sync.Mutex
+	n      int                  // number of queued jobs
+	queues map[string][]execEnv // keyed by endpoint path, or "" in fifo mode
+	order  []string             // keys of non-empty queues in pick order
+	perRef map[string]int       // queued jobs by refKey, for endpoints limiting them
+}
+
+func newJobQueue(size int, fair bool) *jobQueue {
+	return &jobQueue{
+		notify: make(chan struct{}, 1),
+		space:  make(chan struct{}, 1),
+		fair:   fair,
+		size:   size,
+		queues: make(map[string][]execEnv),
+		perRef: make(map[string]int),
+	}
+}
+
+var (
+	errQueueFull = errors.New("queue is full")
+	errRefLimit  = errors.New("too many queued jobs for ref")
+)
+
+// push adds job to the queue, it returns false if queue is full
+func (q *jobQueue) push(item execEnv) bool {
+	_, err := q.add(item, false)
+	return err == nil
+}
+
+// pushRef adds job to the queue honoring per-ref limit of job endpoint, see
+// endpoint.RefQueueLimit. Once job ref has as many jobs queued as endpoint
+// allows, either the oldest of them is dropped and returned, or, unless
+// endpoint is set to drop oldest jobs, new job is not queued and errRefLimit
+// is returned. With wait set, it waits for a free slot while queue is full
+// until ctx is done, otherwise it returns errQueueFull at once.
+func (q *jobQueue) pushRef(ctx context.Context, item execEnv, wait bool) (*execEnv, error) {
+	for {
+		dropped, err := q.add(item, true)
+		if err != errQueueFull || !wait {
+			return dropped, err
+		}
+		select {
+		case <-q.space:
+		case <-ctx.Done():
+			return nil, errQueueFull
+		}
+	}
+}
+
+// add adds job to the queue, enforcing per-ref limit if limit is set, see
+// pushRef
+func (q *jobQueue) add(item execEnv, limit bool) (*execEnv, error) {
+	var key string
+	if q.fair {
+		key = item.endpoint.path
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var evict bool
+	if lim := item.endpoint.RefQueueLimit; limit && lim > 0 && q.perRef[refKey(item)] >= lim {
+		if item.endpoint.RefQueuePolicy != "dropoldest" {
+			return nil, errRefLimit
+		}
+		evict = true
+	}
+	// only evict once it's known to free a slot for the new job, so that
+	// evicted job is not lost if queue is still full, i.e. after it shrank
+	free := q.size - q.n
+	if evict {
+		free++
+	}
+	if free <= 0 {
+		return nil, errQueueFull
+	}
+	var dropped *execEnv
+	if evict {
+		if old, ok := q.removeOldest(key, refKey(item)); ok {
+			dropped = &old
+		}
+	}
+	if q.n >= q.size {
+		return nil, errQueueFull
+	}
+	if len(q.queues[key]) == 0 {
+		q.order = append(q.order, key)
+	}
+	q.queues[key] = append(q.queues[key], item)
+	q.n++
+	if item.endpoint.RefQueueLimit > 0 {
+		q.perRef[refKey(item)]++
+	}
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	if q.n < q.size {
+		q.signalSpace() // pass it on to another waiting pushWait
+	}
+	return dropped, nil
+}
+
+// pushWait adds job to the queue, waiting for a free slot while it's full; it
+// returns false if ctx is done before job is queued
+func (q *jobQueue) pushWait(ctx context.Context, item execEnv) bool {
+	for !q.push(item) {
+		select {
+		case <-q.space:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+func (q *jobQueue) signalSpace() {
+	select {
+	case q.space <- struct{}{}:
+	default:
+	}
+}
+
+// pop removes the next job from the queue, it returns false if queue is empty
+func (q *jobQueue) pop() (execEnv, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.n == 0 {
+		return execEnv{}, false
+	}
+	key := q.order[0]
+	jobs := q.queues[key]
+	item := jobs[0]
+	jobs[0] = execEnv{}
+	if jobs = jobs[1:]; len(jobs) == 0 {
+		delete(q.queues, key)
+		q.order = q.order[1:]
+	} else {
+		q.queues[key] = jobs
+		q.order = append(q.order[1:], key)
+	}
+	q.n--
+	q.uncount(item)
+	if q.n < q.size { // may still be over size after resize
+		q.signalSpace()
+	}
+	return item, true
+}
+
+// refKey identifies endpoint and ref of job for per-ref queue limits
+func refKey(item execEnv) string {
+	return item.endpoint.path + " " + item.payload.Ref
+}
+
+// uncount updates per-ref counters for job removed from the queue. Must be
+// called with q.mu held.
+func (q *jobQueue) uncount(item execEnv) {
+	if item.endpoint.RefQueueLimit <= 0 {
+		return
+	}
+	k := refKey(item)
+	if q.perRef[k]--; q.perRef[k] <= 0 {
+		delete(q.perRef, k)
+	}
+}
+
+// removeOldest removes the oldest job with given refKey from queue for key,
+// returning it. Must be called with q.mu held.
+func (q *jobQueue) removeOldest(key, ref string) (execEnv, bool) {
+	jobs := q.queues[key]
+	for i, job := range jobs {
+		if refKey(job) != ref {
+			continue
+		}
+		jobs = append(jobs[:i], jobs[i+1:]...)
+		if len(jobs) == 0 {
+			delete(q.queues, key)
+			q.order = slices.DeleteFunc(q.order, func(s string) bool { return s == key })
+		} else {
+			q.queues[key] = jobs
+		}
+		q.n--
+		q.uncount(job)
+		return job, true
+	}
+	return execEnv{}, false
+}
+
+// resize changes maximum number of queued jobs, it returns false if size is
+// unchanged. Jobs already queued over the new size are kept: until enough of
+// them are popped, queue has no free slot, and dropoldest doesn't evict.
+func (q *jobQueue) resize(size int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.size == size {
+		return false
+	}
+	q.size = size
+	q.signalSpace() // in case it grew, wake pushWait
+	return true
+}
+
+// len returns number of queued jobs
+func (q *jobQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.n
+}
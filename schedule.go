@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// schedule restricts the time commands are allowed to run at
+type schedule struct {
+	Timezone string   // location name as in tz database, local time if empty
+	Windows  []string // time ranges like "18:00-08:00", may wrap midnight
+	Days     []string // weekdays like "Mon", any day if empty
+	Defer    bool     // postpone job until next window instead of skipping it
+
+	loc     *time.Location
+	windows [][2]int // start and end as minutes since midnight
+	days    map[time.Weekday]bool
+}
+
+// init validates schedule and prepares it for use, it must be called before
+// schedule is used
+func (s *schedule) init() error {
+	s.loc = time.Local
+	if len(s.Timezone) > 0 {
+		loc, err := time.LoadLocation(s.Timezone)
+		if err != nil {
+			return err
+		}
+		s.loc = loc
+	}
+	if len(s.Windows) == 0 {
+		return fmt.Errorf("no windows defined")
+	}
+	s.windows = make([][2]int, 0, len(s.Windows))
+	for _, w := range s.Windows {
+		var h1, m1, h2, m2 int
+		if n, err := fmt.Sscanf(w, "%d:%d-%d:%d", &h1, &m1, &h2, &m2); n != 4 || err != nil {
+			return fmt.Errorf("malformed window %q", w)
+		}
+		start, end := h1*60+m1, h2*60+m2
+		if h1 < 0 || h2 < 0 || m1 < 0 || m1 > 59 || m2 < 0 || m2 > 59 ||
+			start > 24*60 || end > 24*60 {
+			return fmt.Errorf("malformed window %q", w)
+		}
+		s.windows = append(s.windows, [2]int{start, end})
+	}
+	if len(s.Days) == 0 {
+		return nil
+	}
+	s.days = make(map[time.Weekday]bool)
+	for _, d := range s.Days {
+		wd, ok := weekdays[d]
+		if !ok {
+			return fmt.Errorf("unknown weekday %q", d)
+		}
+		s.days[wd] = true
+	}
+	return nil
+}
+
+// allows reports whether t falls inside of any schedule window
+func (s *schedule) allows(t time.Time) bool {
+	t = t.In(s.loc)
+	if s.days != nil && !s.days[t.Weekday()] {
+		return false
+	}
+	min := t.Hour()*60 + t.Minute()
+	for _, w := range s.windows {
+		switch {
+		case w[0] <= w[1]:
+			if min >= w[0] && min < w[1] {
+				return true
+			}
+		default: // wraps midnight
+			if min >= w[0] || min < w[1] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// next returns the earliest time after t allowed by schedule; if schedule
+// allows no time at all, it returns t + 1 week
+func (s *schedule) next(t time.Time) time.Time {
+	c := t.Truncate(time.Minute)
+	for i := 0; i < 8*24*60; i++ {
+		c = c.Add(time.Minute)
+		if s.allows(c) {
+			return c
+		}
+	}
+	return t.Add(7 * 24 * time.Hour)
+}
+
+var weekdays = map[string]time.Weekday{
+	"Sun": time.Sunday,
+	"Mon": time.Monday,
+	"Tue": time.Tuesday,
+	"Wed": time.Wednesday,
+	"Thu": time.Thursday,
+	"Fri": time.Friday,
+	"Sat": time.Saturday,
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+// secretAgeInterval is how often secret ages are checked
+const secretAgeInterval = 24 * time.Hour
+
+// warnSecretAge logs a warning for every endpoint with secret rotated longer
+// than max ago, once started and then daily, checking then current config
+func (hh *hookHandler) warnSecretAge(max time.Duration) {
+	ticker := time.NewTicker(secretAgeInterval)
+	defer ticker.Stop()
+	for {
+		hh.mu.RLock()
+		cfg := hh.cfg
+		hh.mu.RUnlock()
+		for _, ep := range staleSecrets(cfg, max, time.Now()) {
+			log.Printf("%s: secret was rotated %d days ago (at %s), longer than %v, consider rotating it",
+				ep.path, int(time.Since(*ep.SecretRotatedAt)/(24*time.Hour)),
+				ep.SecretRotatedAt.Format(time.DateOnly), max)
+		}
+		<-ticker.C
+	}
+}
+
+// staleSecrets returns endpoints with secrets rotated longer than max ago,
+// sorted by path
+func staleSecrets(cfg map[string]endpoint, max time.Duration, now time.Time) []endpoint {
+	var out []endpoint
+	for _, ep := range cfg {
+		if t := ep.SecretRotatedAt; t != nil && len(ep.Secret) > 0 && now.Sub(*t) > max {
+			out = append(out, ep)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].path < out[j].path })
+	return out
+}
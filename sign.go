@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/artyom/autoflags"
+)
+
+// signMain implements "sign" subcommand: it prints signature headers for a
+// payload file, so that valid test requests can be crafted with curl
+func signMain(args []string) {
+	config := struct {
+		Secret string `flag:"secret,webhook secret (GHWH_SECRET environment variable if empty)"`
+		Algo   string `flag:"algo,signature algorithm: sha1 or sha256 (both if empty)"`
+	}{}
+	fs := flag.NewFlagSet("sign", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: ghwh sign [flags] payload.json")
+		fs.PrintDefaults()
+	}
+	autoflags.DefineFlagSet(fs, &config)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if config.Secret == "" {
+		config.Secret = os.Getenv("GHWH_SECRET")
+	}
+	if config.Secret == "" {
+		log.Fatal("secret is not set")
+	}
+	if _, ok := hashes[config.Algo]; config.Algo != "" && !ok {
+		log.Fatalf("unsupported signature algorithm %q", config.Algo)
+	}
+	var b []byte
+	var err error
+	if name := fs.Arg(0); name == "-" {
+		b, err = io.ReadAll(os.Stdin)
+	} else {
+		b, err = os.ReadFile(name)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, h := range signatureHeaders {
+		if config.Algo != "" && h.algo != config.Algo {
+			continue
+		}
+		fmt.Printf("%s: %s=%s\n", h.header, h.algo, hmacHex(h.algo, []byte(config.Secret), b))
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+var (
+	reloadSignals = []os.Signal{syscall.SIGHUP}
+	dumpSignals   []os.Signal
+)
+
+func isDumpSignal(os.Signal) bool { return false }
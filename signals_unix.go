@@ -0,0 +1,15 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+var (
+	reloadSignals = []os.Signal{syscall.SIGHUP, syscall.SIGUSR1}
+	dumpSignals   = []os.Signal{syscall.SIGUSR2}
+)
+
+func isDumpSignal(sig os.Signal) bool { return sig == syscall.SIGUSR2 }
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// spillQueue keeps jobs the main queue has no room for as files in a
+// directory, so that they are not lost on bursts or restarts. Files are
+// named so that their lexical order is the order jobs were spilled in.
+type spillQueue struct {
+	dir string
+	max int // maximum number of spilled jobs
+
+	mu  sync.Mutex
+	n   int // number of spilled jobs
+	seq int
+}
+
+// spilledJob is a serialized form of execEnv. Endpoint is stored by its
+// config key and looked up in the current config on replay.
+type spilledJob struct {
+	Endpoint  string            `json:"endpoint"`
+	Event     string            `json:"event"`
+	Payload   hookPayload       `json:"payload"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	RequestID string            `json:"request_id"`
+	GHES      string            `json:"ghes,omitempty"`
+
+	BatchCount int      `json:"batch_count,omitempty"`
+	BatchRefs  []string `json:"batch_refs,omitempty"`
+	Body       []byte   `json:"body,omitempty"` // only kept for endpoints with payload file
+}
+
+// serializeJob returns serialized form of job
+func serializeJob(item execEnv) spilledJob {
+	return spilledJob{
+		Endpoint:   item.endpoint.path,
+		Event:      item.event,
+		Payload:    item.payload,
+		Headers:    item.headers,
+		RequestID:  item.requestID,
+		GHES:       item.ghes,
+		BatchCount: item.batchCount,
+		BatchRefs:  item.batchRefs,
+		Body:       item.body,
+	}
+}
+
+const spillSuffix = ".job"
+
+var errSpillFull = errors.New("spill directory is full")
+
+// newSpillQueue returns spillQueue keeping jobs in dir, which is created if
+// needed; jobs already there are replayed
+func newSpillQueue(dir string, max int) (*spillQueue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	sq := &spillQueue{dir: dir, max: max}
+	names, err := sq.list()
+	if err != nil {
+		return nil, err
+	}
+	sq.n = len(names)
+	return sq, nil
+}
+
+// push writes job to a new file in spill directory
+func (sq *spillQueue) push(item execEnv) error {
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+	if sq.n >= sq.max {
+		return errSpillFull
+	}
+	b, err := json.Marshal(serializeJob(item))
+	if err != nil {
+		return err
+	}
+	sq.seq++
+	name := filepath.Join(sq.dir, fmt.Sprintf("%020d-%06d%s",
+		time.Now().UnixNano(), sq.seq%1000000, spillSuffix))
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	sq.n++
+	return nil
+}
+
+// len returns number of spilled jobs
+func (sq *spillQueue) len() int {
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+	return sq.n
+}
+
+// list returns paths of spilled job files in order they were spilled
+func (sq *spillQueue) list() ([]string, error) {
+	entries, err := os.ReadDir(sq.dir)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, e := range entries {
+		if e.Type().IsRegular() && strings.HasSuffix(e.Name(), spillSuffix) {
+			out = append(out, filepath.Join(sq.dir, e.Name()))
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// remove deletes spilled job file
+func (sq *spillQueue) remove(name string) {
+	if err := os.Remove(name); err != nil {
+		log.Printf("spilled job removal: %v", err)
+	}
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+	if sq.n > 0 {
+		sq.n--
+	}
+}
+
+// unspill moves spilled jobs to the main queue while it has room. Jobs of
+// endpoints no longer configured are dropped.
+func (hh *hookHandler) unspill() {
+	if hh.spill == nil || hh.spill.len() == 0 {
+		return
+	}
+	names, err := hh.spill.list()
+	if err != nil {
+		log.Printf("listing spilled jobs: %v", err)
+		return
+	}
+	for _, name := range names {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			log.Printf("loading spilled job: %v", err)
+			return
+		}
+		var job spilledJob
+		if err := json.Unmarshal(b, &job); err != nil {
+			log.Printf("dropping malformed spilled job %s: %v", name, err)
+			hh.spill.remove(name)
+			continue
+		}
+		item, ok := hh.resolve(job)
+		if !ok {
+			log.Printf("repo: %q, ref: %q, id: %q, endpoint %s is no longer configured, dropping spilled job",
+				job.Payload.Repository.Name, job.Payload.Ref, job.RequestID, job.Endpoint)
+			hh.spill.remove(name)
+			continue
+		}
+		if err := hh.journal.add(&item); err != nil {
+			log.Printf("journal: %v", err)
+			return
+		}
+		if !hh.queue.push(item) {
+			hh.journal.remove(item)
+			return
+		}
+		hh.spill.remove(name)
+	}
+}
+
+// resolve restores job from its serialized form, looking up its endpoint in
+// the current config
+func (hh *hookHandler) resolve(job spilledJob) (execEnv, bool) {
+	hh.mu.RLock()
+	ep, ok := hh.cfg[job.Endpoint]
+	hh.mu.RUnlock()
+	if !ok {
+		return execEnv{}, false
+	}
+	if ep.AppMode {
+		sub, ok := ep.Repos[job.Payload.Repository.FullName]
+		if !ok {
+			return execEnv{}, false
+		}
+		ep = ep.forRepo(sub)
+	}
+	return execEnv{
+		event:      job.Event,
+		payload:    job.Payload,
+		endpoint:   ep,
+		headers:    job.Headers,
+		requestID:  job.RequestID,
+		ghes:       job.GHES,
+		batchCount: job.BatchCount,
+		batchRefs:  job.BatchRefs,
+		body:       job.Body,
+	}, true
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// endpointStats holds per-endpoint counters
+type endpointStats struct {
+	Accepted int64 `json:"accepted"` // deliveries queued
+	Runs     int64 `json:"runs"`     // jobs processed
+	Failures int64 `json:"failures"` // jobs failed
+	Skipped  int64 `json:"skipped"`  // jobs skipped while endpoint was paused
+
+	// error of the last job, cleared when job succeeds
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorTime *time.Time `json:"last_error_time,omitempty"`
+	// exit code of the last command, -1 if it was killed by signal; unset
+	// if the last job failed without command exiting, i.e. failed to start
+	LastExitCode *int `json:"last_exit_code,omitempty"`
+	// the last successful run
+	LastDeploy *deployMarker `json:"last_deploy,omitempty"`
+}
+
+// statsRegistry tracks stats of all endpoints, keyed by endpoint path
+type statsRegistry struct {
+	mu sync.Mutex
+	m  map[string]*endpointStats
+}
+
+func newStatsRegistry() *statsRegistry {
+	return &statsRegistry{m: make(map[string]*endpointStats)}
+}
+
+// update calls fn with stats of given endpoint under lock
+func (s *statsRegistry) update(path string, fn func(*endpointStats)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.m[path]
+	if !ok {
+		st = new(endpointStats)
+		s.m[path] = st
+	}
+	fn(st)
+}
+
+// snapshot returns copy of stats of all endpoints
+func (s *statsRegistry) snapshot() map[string]endpointStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]endpointStats, len(s.m))
+	for k, st := range s.m {
+		out[k] = *st
+	}
+	return out
+}
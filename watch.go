@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce is how long config file has to stay unchanged before it is
+// reloaded, so that a file written in several steps is only loaded once
+const watchDebounce = 500 * time.Millisecond
+
+// watchConfig reloads config whenever its file changes on disk. It watches
+// directory file is in, so that editors replacing file by rename are handled
+// too. If new config cannot be loaded, the previous one is kept.
+func (hh *hookHandler) watchConfig(fileName string) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := w.Add(filepath.Dir(fileName)); err != nil {
+		w.Close()
+		return err
+	}
+	name := filepath.Clean(fileName)
+	reload := func() {
+		if err := hh.reload(fileName); err != nil {
+			log.Printf("config reload: %v", err)
+			return
+		}
+		log.Print("config reloaded on file change")
+	}
+	go func() {
+		defer w.Close()
+		var t *time.Timer
+		for {
+			select {
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(ev.Name) != name || !ev.Has(fsnotify.Write|fsnotify.Create) {
+					continue
+				}
+				if t == nil {
+					t = time.AfterFunc(watchDebounce, reload)
+				} else {
+					t.Reset(watchDebounce)
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("config watch: %v", err)
+			}
+		}
+	}()
+	return nil
+}